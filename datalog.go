@@ -51,6 +51,8 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"strconv"
+	"sync"
 )
 
 // Notes on uniqueness: The datalog engine must be able to tell when two
@@ -200,6 +202,29 @@ func (l *Literal) String() string {
 	return buf.String()
 }
 
+// pattern returns a string representation of a literal with each variable
+// written as "_", for use in error messages about renamed literals.
+func (l *Literal) pattern() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v", l.Pred)
+	for i, arg := range l.Arg {
+		if i == 0 {
+			buf.WriteString("(")
+		} else {
+			buf.WriteString(", ")
+		}
+		if arg.Variable() {
+			buf.WriteString("_")
+		} else {
+			fmt.Fprintf(&buf, "%v", arg)
+		}
+	}
+	if len(l.Arg) > 0 {
+		buf.WriteString(")")
+	}
+	return buf.String()
+}
+
 // tag returns a "variant tag" for a literal, such that two literals have the
 // same variant tag if and only if they are identical modulo variable renaming.
 func (l *Literal) tag() string {
@@ -220,11 +245,13 @@ func (l *Literal) tagf(buf *bytes.Buffer, varNum map[id]int) {
 	// Tag encoding: hex(pred-id),term,term,...
 	// with varMap, term consts are hex, term vars are "v0", "v1", ...
 	// with no varMap, terms are all hex
-	fmt.Fprintf(buf, "%x", l.Pred.pID())
+	var scratch [20]byte
+	buf.Write(strconv.AppendUint(scratch[:0], uint64(l.Pred.pID()), 16))
 	for _, arg := range l.Arg {
 		switch arg := arg.(type) {
 		case Const:
-			fmt.Fprintf(buf, ",%x", arg.cID())
+			buf.WriteByte(',')
+			buf.Write(strconv.AppendUint(scratch[:0], uint64(arg.cID()), 16))
 		case Var:
 			vid := arg.vID()
 			num, ok := varNum[vid]
@@ -232,7 +259,8 @@ func (l *Literal) tagf(buf *bytes.Buffer, varNum map[id]int) {
 				num = len(varNum)
 				varNum[vid] = num
 			}
-			fmt.Fprintf(buf, ",v%d", num)
+			buf.WriteString(",v")
+			buf.Write(strconv.AppendInt(scratch[:0], int64(num), 10))
 		default:
 			panic("datalog: not reached -- term is always Var or Const")
 		}
@@ -279,11 +307,13 @@ type Pred interface {
 
 	// Assert introduces new information about a predicate. Assert is only
 	// called by the prover for Pred p if clause is safe and p == c.Head.Pred.
-	Assert(clause *Clause) error
+	// The result indicates whether anything new was added.
+	Assert(clause *Clause) (bool, error)
 
 	// Retract removes information about a predicate. Retract is only called by
-	// the prover for Pred p if p == c.Head.Pred.
-	Retract(clause *Clause) error
+	// the prover for Pred p if p == c.Head.Pred. The clauses that were removed,
+	// if any, are returned.
+	Retract(clause *Clause) ([]*Clause, error)
 
 	// Search is called by the prover to discover information about a predicate.
 	// For each fact or rule whose head unifies with the target, Search should
@@ -291,6 +321,47 @@ type Pred interface {
 	Search(target *Literal, discovered func(c *Clause))
 }
 
+// Checker is an optional interface for predicates that can reject a search,
+// e.g. because arguments that must be bound are not. Before calling Search, the
+// prover calls Check, and if it returns an error, the query fails with that
+// error.
+type Checker interface {
+	Check(target *Literal) error
+}
+
+// ErrSearcher is an optional interface for predicates whose search can fail
+// after it starts, e.g. because a Go function called to find facts returns an
+// error. The prover calls SearchErr instead of Search, and if it returns an
+// error, the query fails with that error.
+type ErrSearcher interface {
+	SearchErr(target *Literal, discovered func(c *Clause)) error
+}
+
+// Mode describes a pattern of arguments with which a predicate can be
+// searched, and the estimated cost of such a search.
+type Mode struct {
+	// Pattern has one character for each argument: 'b' for an argument that
+	// must be bound to a constant, and 'f' for an argument that need not be.
+	Pattern string
+
+	// Cost is the estimated cost of a search, relative to a search of a
+	// predicate without modes, such as a DBPred, which is taken to cost 1.
+	Cost float64
+}
+
+// Moded is an optional interface for predicates that can be searched only with
+// certain arguments bound, like arithmetic primitives. Modes returns each
+// pattern of arguments that the predicate supports. A rule is safe only if its
+// body literals can be searched in some order such that each has a supported
+// pattern, counting the variables of the head and of earlier literals as bound.
+// Queries that don't bind the head variables a rule needs fail with an error.
+// While proving a rule, the prover next searches the body literal with the
+// lowest cost among those with a supported pattern, preferring earlier literals
+// if costs are equal, and delays the others.
+type Moded interface {
+	Modes() []Mode
+}
+
 // DistinctPred can be embedded as an anonymous field in a struct T, enabling
 // *T to be used as a Pred.
 type DistinctPred struct {
@@ -329,24 +400,87 @@ func (p *DistinctPred) SetArity(arity int) {
 }
 
 // DBPred holds a predicate that is defined by a database of facts and rules.
+// The database has set semantics: it never holds two clauses that are
+// identical modulo variable renaming. The clauses are kept in a Store, by
+// default a SliceStore. Assert and Retract may be called concurrently with
+// NewSnapshot and with queries against snapshots, but not with queries against
+// the live database.
 type DBPred struct {
-	db []*Clause
+	mu    sync.Mutex // guards store
+	store Store
 	DistinctPred
 }
 
+// SetStore sets the store that holds the database for this predicate. This
+// function should be called only early when initializing a new DBPred, before
+// any clauses are asserted.
+func (p *DBPred) SetStore(s Store) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.store = s
+}
+
+// db returns the store for this predicate, creating a SliceStore if none was
+// set. Caller must hold p.mu.
+func (p *DBPred) db() Store {
+	if p.store == nil {
+		p.store = NewSliceStore()
+	}
+	return p.store
+}
+
+// dbPred returns the DBPred. This allows the prover and snapshots to find the
+// database for any Pred that embeds DBPred.
+func (p *DBPred) dbPred() *DBPred {
+	return p
+}
+
+// dbHolder is implemented by DBPred and by all types that embed it.
+type dbHolder interface {
+	dbPred() *DBPred
+}
+
+// Clauses returns the facts and rules currently in the database for this
+// predicate. The caller may modify the returned slice.
+func (p *DBPred) Clauses() ([]*Clause, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return collect(p.db(), nil)
+}
+
+// share returns a view of the current database for this predicate that will
+// not be affected by future changes. Caller must hold p.mu.
+func (p *DBPred) share() (Store, error) {
+	if s, ok := p.db().(Snapshotter); ok {
+		return s.Snapshot(), nil
+	}
+	s := NewSliceStore()
+	db, err := collect(p.db(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for _, c := range db {
+		s.Insert(c.tag(), c)
+	}
+	return s, nil
+}
+
 // Assert checks if the clause is safe then calls Assert() on the appropriate
-// Pred.
-func (c *Clause) Assert() error {
-	if !c.Safe() {
-		return errors.New("datalog: can't assert unsafe clause")
+// Pred. The result indicates whether anything new was added.
+func (c *Clause) Assert() (bool, error) {
+	if err := c.unsafe(); err != nil {
+		return false, errors.New("datalog: can't assert " + err.Error())
 	}
 	return c.Head.Pred.Assert(c)
 }
 
-// Assert for a DBPred inserts c into the database for this predicate.
-func (p *DBPred) Assert(c *Clause) error {
-	p.db = append(p.db, c)
-	return nil
+// Assert for a DBPred inserts c into the database for this predicate, unless
+// the database already holds a clause that is identical to c modulo variable
+// renaming. The result indicates whether c was inserted.
+func (p *DBPred) Assert(c *Clause) (bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.db().Insert(c.tag(), c)
 }
 
 // tag returns a "variant tag" for a clause, such that two clauses have the
@@ -361,23 +495,73 @@ func (c *Clause) tag() string {
 	return buf.String()
 }
 
-// Retract calls Retract() on the appropriate Pred.
-func (c *Clause) Retract() error {
+// Retract calls Retract() on the appropriate Pred, returning the clauses that
+// were removed.
+func (c *Clause) Retract() ([]*Clause, error) {
 	return c.Head.Pred.Retract(c)
 }
 
-// Retract for a DBPred removes a clause from the relevant database, along with
-// all structurally identical clauses modulo variable renaming.
-func (p *DBPred) Retract(c *Clause) error {
-	tag := c.tag()
-	for i := 0; i < len(p.db); i++ {
-		if p.db[i].tag() == tag {
-			n := len(p.db)
-			p.db[i], p.db[n-1], p.db = p.db[n-1], nil, p.db[:n-1]
-			i--
+// Retract for a DBPred removes the clause from the relevant database that is
+// structurally identical to c modulo variable renaming. The removed clause, if
+// any, is returned. It is not an error if there was none.
+func (p *DBPred) Retract(c *Clause) ([]*Clause, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	removed, err := p.db().Delete(c.tag())
+	if removed == nil {
+		return nil, err
+	}
+	return []*Clause{removed}, err
+}
+
+// RetractMatching removes every fact, i.e. every clause with an empty body,
+// whose head unifies with pattern. Unlike Retract, which removes only variants
+// of a given clause, this can be used to remove a whole family of facts, e.g.
+// session(bob, X). The removed facts are returned. Rules are never removed.
+func (p *DBPred) RetractMatching(pattern *Literal) ([]*Clause, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	db, err := collect(p.db(), pattern)
+	if err != nil {
+		return nil, err
+	}
+	var removed []*Clause
+	for _, c := range db {
+		if len(c.Body) == 0 && unify(pattern, c.Head) != nil {
+			if _, err := p.db().Delete(c.tag()); err != nil {
+				return removed, err
+			}
+			removed = append(removed, c)
 		}
 	}
-	return nil
+	return removed, nil
+}
+
+// Clear removes all facts and rules from the database for this predicate,
+// returning the removed clauses.
+func (p *DBPred) Clear() ([]*Clause, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	db, err := collect(p.db(), nil)
+	if err != nil {
+		return nil, err
+	}
+	for i, c := range db {
+		if _, err := p.db().Delete(c.tag()); err != nil {
+			return db[:i], err
+		}
+	}
+	return db, nil
+}
+
+// RetractMatching calls RetractMatching() on the appropriate Pred, which must
+// embed DBPred.
+func (l *Literal) RetractMatching() ([]*Clause, error) {
+	h, ok := l.Pred.(dbHolder)
+	if !ok {
+		return nil, errors.New("datalog: can't retract by pattern for custom predicates")
+	}
+	return h.dbPred().RetractMatching(l)
 }
 
 // Answers to a query are facts.
@@ -399,11 +583,41 @@ func (a Answers) String() string {
 	}
 }
 
-// Query returns a list of facts that unify with the given literal.
+// Query returns a list of facts that unify with the given literal. If a
+// predicate rejects or fails the search (see Checker and ErrSearcher), no facts
+// are returned. Use QueryErr to learn of such errors.
 func (l *Literal) Query() Answers {
-	facts := make(query).search(l).facts
+	a, _ := l.QueryErr()
+	return a
+}
+
+// QueryErr is like Query, but it returns an error if a predicate rejects or
+// fails the search (see Checker and ErrSearcher).
+func (l *Literal) QueryErr() (Answers, error) {
+	return newQuery(nil).answer(l)
+}
+
+// QueryAssuming returns a list of facts that unify with the given literal, as if
+// the assumed facts and rules had been asserted beforehand. The database is not
+// modified: the assumptions are visible only to this query. An error is
+// returned if any of the assumed clauses is not safe, or if a predicate rejects
+// or fails the search (see Checker and ErrSearcher).
+func (l *Literal) QueryAssuming(assumed ...*Clause) (Answers, error) {
+	q := newQuery(nil)
+	if err := q.assume(assumed); err != nil {
+		return nil, err
+	}
+	return q.answer(l)
+}
+
+// answer runs the prover on the given literal and collects the answers.
+func (q *query) answer(l *Literal) (Answers, error) {
+	facts := q.search(l).facts
+	if q.err != nil {
+		return nil, q.err
+	}
 	if len(facts) == 0 {
-		return nil
+		return nil, nil
 	}
 	a := make(Answers, len(facts))
 	i := 0
@@ -411,7 +625,7 @@ func (l *Literal) Query() Answers {
 		a[i] = fact
 		i++
 	}
-	return a
+	return a, nil
 }
 
 // An env maps variables to terms. It is used for substitutions.
@@ -561,8 +775,15 @@ func (l *Literal) hasVar(v Var) bool {
 }
 
 // Safe checks whether a clause is safe, that is, whether every variable in the
-// head also appears in the body.
+// head also appears in the body, and whether the body literals can be searched
+// in an order that meets their mode requirements, if the head variables are
+// bound (see Moded).
 func (c *Clause) Safe() bool {
+	return c.unsafe() == nil
+}
+
+// unsafe returns an error if c is not safe.
+func (c *Clause) unsafe() error {
 	for _, arg := range c.Head.Arg {
 		if v, ok := arg.(Var); ok {
 			safe := false
@@ -573,28 +794,112 @@ func (c *Clause) Safe() bool {
 				}
 			}
 			if !safe {
-				return false
+				return errors.New("unsafe clause")
 			}
 		}
 	}
-	return true
+	// Head variables count as bound, since a query may bind them, as in
+	// p(X, Y) :- Y = X + 1.
+	bound := make(map[Var]bool)
+	for _, arg := range c.Head.Arg {
+		if v, ok := arg.(Var); ok {
+			bound[v] = true
+		}
+	}
+	isBound := func(t Term) bool {
+		v, ok := t.(Var)
+		return !ok || bound[v]
+	}
+	remaining := append([]*Literal(nil), c.Body...)
+	for len(remaining) > 0 {
+		i := 0
+		for i < len(remaining) {
+			if _, ok := remaining[i].cost(isBound); ok {
+				break
+			}
+			i++
+		}
+		if i == len(remaining) {
+			return fmt.Errorf("unsafe clause: arguments of %v are never bound", remaining[0])
+		}
+		for _, arg := range remaining[i].Arg {
+			if v, ok := arg.(Var); ok {
+				bound[v] = true
+			}
+		}
+		remaining = append(remaining[:i], remaining[i+1:]...)
+	}
+	return nil
+}
+
+// cost returns the lowest estimated cost of a search for l, given which terms
+// are bound, and whether l can be searched at all (see Moded).
+func (l *Literal) cost(bound func(t Term) bool) (float64, bool) {
+	m, ok := l.Pred.(Moded)
+	if !ok {
+		return 1, true
+	}
+	cost, found := 0.0, false
+	for _, mode := range m.Modes() {
+		if len(mode.Pattern) != len(l.Arg) || (found && mode.Cost >= cost) {
+			continue
+		}
+		fits := true
+		for i, p := range mode.Pattern {
+			if p == 'b' && !bound(l.Arg[i]) {
+				fits = false
+				break
+			}
+		}
+		if fits {
+			cost, found = mode.Cost, true
+		}
+	}
+	return cost, found
 }
 
 // The remainder of this file implements the datalog prover.
 
-// query tracks a set of subgoals, indexed by subgoal target tag.
-type query map[string]*subgoal
+// query tracks a set of subgoals, indexed by subgoal target tag, and the view
+// of the database that the prover uses to satisfy them.
+type query struct {
+	subgoals map[string]*subgoal
+	snap     *Snapshot          // if non-nil, DBPred databases are taken from here
+	assumed  map[Pred][]*Clause // hypothetical clauses layered over the database
+	err      error              // first error from a Checker, an ErrSearcher, or a rule
+}
+
+// newQuery creates a new query. If snap is nil, the prover will use the live
+// database, otherwise it will use the given snapshot.
+func newQuery(snap *Snapshot) *query {
+	return &query{subgoals: make(map[string]*subgoal), snap: snap}
+}
+
+// assume adds hypothetical clauses to be used, in addition to the database,
+// for the duration of the query. Each clause must be safe.
+func (q *query) assume(assumed []*Clause) error {
+	for _, c := range assumed {
+		if err := c.unsafe(); err != nil {
+			return errors.New("datalog: can't assume " + err.Error())
+		}
+		if q.assumed == nil {
+			q.assumed = make(map[Pred][]*Clause)
+		}
+		q.assumed[c.Head.Pred] = append(q.assumed[c.Head.Pred], c)
+	}
+	return nil
+}
 
 // newSubgoal creates a new subgoal and adds it to the query's subgoal set.
-func (q query) newSubgoal(target *Literal, waiters []*waiter) *subgoal {
+func (q *query) newSubgoal(target *Literal, waiters []*waiter) *subgoal {
 	sg := &subgoal{target, make(factSet), waiters}
-	q[target.tag()] = sg
+	q.subgoals[target.tag()] = sg
 	return sg
 }
 
 // findSubgoal returns the appropriate subgoal from the query's subgoal set.
-func (q query) findSubgoal(target *Literal) *subgoal {
-	return q[target.tag()]
+func (q *query) findSubgoal(target *Literal) *subgoal {
+	return q.subgoals[target.tag()]
 }
 
 // factSet tracks a set of facts, indexed by tag.
@@ -616,21 +921,60 @@ type waiter struct {
 // search introduces a new subgoal for target, with waiters to be notified upon
 // discovery of new facts that unify with target.
 // Example target: ancestor(X, Y)
-func (q query) search(target *Literal, waiters ...*waiter) *subgoal {
+func (q *query) search(target *Literal, waiters ...*waiter) *subgoal {
 	sg := q.newSubgoal(target, waiters)
-	target.Pred.Search(target, func(c *Clause) {
+	if c, ok := target.Pred.(Checker); ok {
+		if err := c.Check(target); err != nil {
+			if q.err == nil {
+				q.err = err
+			}
+			return sg
+		}
+	}
+	discovered := func(c *Clause) {
 		q.discovered(sg, c)
-	})
+	}
+	var err error
+	if _, ok := target.Pred.(dbHolder); ok && q.snap != nil {
+		err = q.snap.search(target, discovered)
+	} else if s, ok := target.Pred.(ErrSearcher); ok {
+		err = s.SearchErr(target, discovered)
+	} else {
+		target.Pred.Search(target, discovered)
+	}
+	if err != nil && q.err == nil {
+		q.err = err
+	}
+	searchDB(q.assumed[target.Pred], target, discovered)
 	return sg
 }
 
 // Search for DBPred examines facts and rules in the database for this predicate
 // and, if the clause head unifies with the target, reports the discovery.
 func (p *DBPred) Search(target *Literal, discovered func(c *Clause)) {
+	p.SearchErr(target, discovered)
+}
+
+// SearchErr is like Search, but it returns any error from the store, in which
+// case nothing is reported.
+func (p *DBPred) SearchErr(target *Literal, discovered func(c *Clause)) error {
+	p.mu.Lock()
+	db, err := collect(p.db(), target)
+	p.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	searchDB(db, target, discovered)
+	return nil
+}
+
+// searchDB examines facts and rules in db and, if the clause head unifies with
+// the target, reports the discovery.
+func searchDB(db []*Clause, target *Literal, discovered func(c *Clause)) {
 	// Examine each fact or rule clause in the relevant database ...
 	// Example fact: ancestor(alice, bob)
 	// Example rule: ancestor(P, Q) :- parent(P, Q)
-	for _, clause := range p.db {
+	for _, clause := range db {
 		// ... and try to unify target with that clause's head.
 		renamed := clause.rename()
 		e := unify(target, renamed.Head)
@@ -643,7 +987,7 @@ func (p *DBPred) Search(target *Literal, discovered func(c *Clause)) {
 
 // discovered kicks off processing upon discovery of a fact or rule clause
 // whose head unifies with a subgoal target.
-func (q query) discovered(sg *subgoal, clause *Clause) {
+func (q *query) discovered(sg *subgoal, clause *Clause) {
 	if len(clause.Body) == 0 {
 		q.discoveredFact(sg, clause.Head)
 	} else {
@@ -653,7 +997,11 @@ func (q query) discovered(sg *subgoal, clause *Clause) {
 
 // discoveredRule kicks off processing upon discovery of a rule whose head
 // unifies with a subgoal target.
-func (q query) discoveredRule(rulesg *subgoal, rule *Clause) {
+func (q *query) discoveredRule(rulesg *subgoal, rule *Clause) {
+	rule = q.reorder(rule)
+	if rule == nil {
+		return
+	}
 	bodysg := q.findSubgoal(rule.Body[0])
 	if bodysg == nil {
 		// Nothing on body[0], so search for it, but resume processing later.
@@ -678,9 +1026,42 @@ func (q query) discoveredRule(rulesg *subgoal, rule *Clause) {
 	}
 }
 
+// reorder returns rule, or, if another body literal should be searched first, a
+// copy of rule with that literal moved to the front. It chooses the literal with
+// the lowest cost among those that need not be delayed (see Moded). If all of
+// them must be delayed, reorder records an error and returns nil.
+func (q *query) reorder(rule *Clause) *Clause {
+	best, bestCost := -1, 0.0
+	for i, literal := range rule.Body {
+		cost, ok := literal.cost(Term.Constant)
+		if ok && (best < 0 || cost < bestCost) {
+			best, bestCost = i, cost
+		}
+	}
+	if best == 0 {
+		return rule
+	} else if best > 0 {
+		r := &Clause{Head: rule.Head, Body: make([]*Literal, 0, len(rule.Body))}
+		r.Body = append(r.Body, rule.Body[best])
+		r.Body = append(r.Body, rule.Body[:best]...)
+		r.Body = append(r.Body, rule.Body[best+1:]...)
+		return r
+	}
+	if q.err == nil {
+		literal := rule.Body[0]
+		if c, ok := literal.Pred.(Checker); ok {
+			q.err = c.Check(literal)
+		}
+		if q.err == nil {
+			q.err = fmt.Errorf("datalog: %s: arguments are never bound", literal.pattern())
+		}
+	}
+	return nil
+}
+
 // discoveredRule kicks off processing upon discovery of a fact that unifies
 // with a subgoal target.
-func (q query) discoveredFact(factsg *subgoal, fact *Literal) {
+func (q *query) discoveredFact(factsg *subgoal, fact *Literal) {
 	if _, ok := factsg.facts[fact.tag()]; !ok {
 		factsg.facts[fact.tag()] = fact
 		// Resume processing: For each deferred (rulesg, rule) pair, check if rule
@@ -15,6 +15,8 @@
 package datalog
 
 import (
+	"errors"
+	"strings"
 	"testing"
 )
 
@@ -59,17 +61,17 @@ func TestProver(t *testing.T) {
 	// ancestor(X, Z) :- ancestor(X, Y), ancestor(Y, Z)
 	rule := NewClause(NewLiteral(ancestor, x, z),
 		NewLiteral(ancestor, x, y), NewLiteral(ancestor, y, z))
-	if err := rule.Assert(); err != nil {
+	if _, err := rule.Assert(); err != nil {
 		t.Fatal(err.Error())
 	}
 
 	fact1 := NewClause(NewLiteral(ancestor, alice, bob))
-	if err := fact1.Assert(); err != nil {
+	if _, err := fact1.Assert(); err != nil {
 		t.Fatal(err.Error())
 	}
 
 	fact2 := NewClause(NewLiteral(ancestor, bob, carol))
-	if err := fact2.Assert(); err != nil {
+	if _, err := fact2.Assert(); err != nil {
 		t.Fatal(err.Error())
 	}
 
@@ -144,7 +146,7 @@ func TestAssertRetract(t *testing.T) {
 
 	// same(X, X) :- same(felix, felix)
 	rule := NewClause(NewLiteral(same, x, x), NewLiteral(same, felix, felix))
-	if err := rule.Assert(); err == nil {
+	if _, err := rule.Assert(); err == nil {
 		t.Fatal("unsafe rule not detected")
 	}
 	if s := rule.String(); s != "same(X, X) :- same(felix, felix)" {
@@ -153,19 +155,19 @@ func TestAssertRetract(t *testing.T) {
 
 	// same(felix, X) :- same(X, felix).
 	rule = NewClause(NewLiteral(same, felix, x), NewLiteral(same, x, felix))
-	if err := rule.Assert(); err != nil {
+	if _, err := rule.Assert(); err != nil {
 		t.Fatal(err.Error())
 	}
 
 	// same(felix, felix).
 	rule = NewClause(NewLiteral(same, felix, felix))
-	if err := rule.Assert(); err != nil {
+	if _, err := rule.Assert(); err != nil {
 		t.Fatal(err.Error())
 	}
 
 	// same(sylvester, sylvester).
 	rule = NewClause(NewLiteral(same, sylvester, sylvester))
-	if err := rule.Assert(); err != nil {
+	if _, err := rule.Assert(); err != nil {
 		t.Fatal(err.Error())
 	}
 
@@ -193,8 +195,15 @@ func TestAssertRetract(t *testing.T) {
 
 	// same(felix, felix).
 	rule = NewClause(NewLiteral(same, felix, felix))
-	if err := rule.Retract(); err != nil {
+	if removed, err := rule.Retract(); err != nil {
 		t.Fatal(err.Error())
+	} else if len(removed) != 1 {
+		t.Fatalf("unexpected retraction: %v", removed)
+	}
+	if removed, err := rule.Retract(); err != nil {
+		t.Fatal(err.Error())
+	} else if len(removed) != 0 {
+		t.Fatalf("unexpected retraction: %v", removed)
 	}
 
 	// same(x, felix)?
@@ -210,13 +219,13 @@ func TestAssertRetract(t *testing.T) {
 	// same(x, x) :- same(y, y), exists(x)
 	rule = NewClause(NewLiteral(same, x, x),
 		NewLiteral(same, y, y), NewLiteral(exists, x))
-	if err := rule.Assert(); err != nil {
+	if _, err := rule.Assert(); err != nil {
 		t.Fatal(err.Error())
 	}
 
 	// exists(felix).
 	rule = NewClause(NewLiteral(exists, felix))
-	if err := rule.Assert(); err != nil {
+	if _, err := rule.Assert(); err != nil {
 		t.Fatal(err.Error())
 	}
 
@@ -228,3 +237,436 @@ func TestAssertRetract(t *testing.T) {
 	}
 
 }
+
+func TestSnapshot(t *testing.T) {
+	ancestor := new(DBPred)
+	ancestor.SetArity(2)
+	parent := new(DBPred)
+	parent.SetArity(2)
+
+	alice := new(DistinctConst)
+	bob := new(DistinctConst)
+	carol := new(DistinctConst)
+
+	x := new(DistinctVar)
+	y := new(DistinctVar)
+
+	// ancestor(X, Y) :- parent(X, Y)
+	rule := NewClause(NewLiteral(ancestor, x, y), NewLiteral(parent, x, y))
+	if _, err := rule.Assert(); err != nil {
+		t.Fatal(err.Error())
+	}
+	fact1 := NewClause(NewLiteral(parent, alice, bob))
+	if _, err := fact1.Assert(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	snap := NewSnapshot(ancestor, parent)
+
+	fact2 := NewClause(NewLiteral(parent, bob, carol))
+	if _, err := fact2.Assert(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := fact1.Retract(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	query := NewLiteral(ancestor, x, y)
+	if ans := snap.Query(query); len(ans) != 1 || ans[0].Arg[0] != alice {
+		t.Fatalf("unexpected snapshot answer: %v", ans)
+	}
+	if ans := query.Query(); len(ans) != 1 || ans[0].Arg[0] != bob {
+		t.Fatalf("unexpected live answer: %v", ans)
+	}
+
+	// Preds left out of the snapshot appear empty.
+	partial := NewSnapshot(ancestor)
+	if ans := partial.Query(query); len(ans) != 0 {
+		t.Fatalf("unexpected partial snapshot answer: %v", ans)
+	}
+}
+
+func TestSnapshotConsistent(t *testing.T) {
+	const npreds, nfacts = 4, 2000
+	preds := make([]Pred, npreds)
+	for i := range preds {
+		p := new(DBPred)
+		p.SetArity(1)
+		preds[i] = p
+	}
+	// A writer asserts p0(c), then p1(c), and so on, for each c.
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < nfacts; i++ {
+			c := new(DistinctConst)
+			for _, p := range preds {
+				if _, err := NewClause(NewLiteral(p, c)).Assert(); err != nil {
+					t.Error(err)
+				}
+			}
+		}
+		close(done)
+	}()
+	// Every snapshot holds at least as many facts for each predicate as for
+	// the next, and at most one more.
+	x := new(DistinctVar)
+	for finished := false; !finished; {
+		select {
+		case <-done:
+			finished = true
+		default:
+		}
+		snap := NewSnapshot(preds...)
+		n := make([]int, npreds)
+		for i, p := range preds {
+			n[i] = len(snap.Query(NewLiteral(p, x)))
+		}
+		for i := 1; i < npreds; i++ {
+			if n[i] > n[i-1] || n[i] < n[i-1]-1 {
+				t.Fatalf("inconsistent snapshot: %v facts", n)
+			}
+		}
+	}
+}
+
+func TestQueryAssuming(t *testing.T) {
+	access := new(DBPred)
+	access.SetArity(2)
+	role := new(DBPred)
+	role.SetArity(2)
+
+	alice := new(DistinctConst)
+	admin := new(DistinctConst)
+	secrets := new(DistinctConst)
+
+	x := new(DistinctVar)
+
+	// access(X, secrets) :- role(X, admin)
+	rule := NewClause(NewLiteral(access, x, secrets), NewLiteral(role, x, admin))
+	if _, err := rule.Assert(); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	query := NewLiteral(access, alice, x)
+	grant := NewClause(NewLiteral(role, alice, admin))
+	ans, err := query.QueryAssuming(grant)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(ans) != 1 || ans[0].Arg[1] != secrets {
+		t.Fatalf("unexpected answer: %v", ans)
+	}
+
+	// The assumption is discarded afterwards.
+	if ans := query.Query(); len(ans) != 0 {
+		t.Fatalf("unexpected answer: %v", ans)
+	}
+
+	unsafe := NewClause(NewLiteral(role, x, admin))
+	if _, err := query.QueryAssuming(unsafe); err == nil {
+		t.Fatal("unsafe assumption not detected")
+	}
+
+	snap := NewSnapshot(access, role)
+	ans, err = snap.QueryAssuming(query, grant)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(ans) != 1 {
+		t.Fatalf("unexpected snapshot answer: %v", ans)
+	}
+}
+
+func TestRetractMatching(t *testing.T) {
+	session := new(DBPred)
+	session.SetArity(2)
+	active := new(DBPred)
+	active.SetArity(1)
+
+	alice := new(DistinctConst)
+	bob := new(DistinctConst)
+	s1 := new(DistinctConst)
+	s2 := new(DistinctConst)
+
+	x := new(DistinctVar)
+	y := new(DistinctVar)
+
+	for _, c := range []*Clause{
+		NewClause(NewLiteral(session, alice, s1)),
+		NewClause(NewLiteral(session, bob, s1)),
+		NewClause(NewLiteral(session, bob, s2)),
+		NewClause(NewLiteral(session, x, y), NewLiteral(active, x), NewLiteral(active, y)),
+	} {
+		if _, err := c.Assert(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	removed, err := NewLiteral(session, bob, x).RetractMatching()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(removed) != 2 {
+		t.Fatalf("expected 2 facts removed, got %v", removed)
+	}
+	if ans := NewLiteral(session, x, y).Query(); len(ans) != 1 || ans[0].Arg[0] != alice {
+		t.Fatalf("unexpected answer: %v", ans)
+	}
+
+	// Rules are not removed, even if their heads match.
+	removed, _ = session.RetractMatching(NewLiteral(session, x, y))
+	if len(removed) != 1 {
+		t.Fatalf("expected 1 fact removed, got %v", removed)
+	}
+	if removed, _ = session.Clear(); len(removed) != 1 || len(removed[0].Body) != 2 {
+		t.Fatalf("expected rule removed, got %v", removed)
+	}
+	if removed, _ = session.Clear(); len(removed) != 0 {
+		t.Fatalf("unexpected clauses removed: %v", removed)
+	}
+}
+
+func TestAssertDuplicate(t *testing.T) {
+	ancestor := new(DBPred)
+	ancestor.SetArity(2)
+
+	alice := new(DistinctConst)
+	bob := new(DistinctConst)
+
+	x := new(DistinctVar)
+	y := new(DistinctVar)
+	z := new(DistinctVar)
+
+	fact := NewClause(NewLiteral(ancestor, alice, bob))
+	rule1 := NewClause(NewLiteral(ancestor, x, z),
+		NewLiteral(ancestor, x, y), NewLiteral(ancestor, y, z))
+	rule2 := NewClause(NewLiteral(ancestor, y, x),
+		NewLiteral(ancestor, y, z), NewLiteral(ancestor, z, x))
+
+	for i, c := range []*Clause{fact, rule1, fact, rule2, NewClause(NewLiteral(ancestor, alice, bob))} {
+		added, err := c.Assert()
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if added != (i < 2) {
+			t.Fatalf("assertion %d: expected added=%v", i, i < 2)
+		}
+	}
+	if db, _ := ancestor.Clauses(); len(db) != 2 {
+		t.Fatalf("expected 2 clauses in database, got %d", len(db))
+	}
+
+	if removed, _ := rule2.Retract(); len(removed) != 1 || removed[0] != rule1 {
+		t.Fatalf("unexpected retraction: %v", removed)
+	}
+	if added, _ := rule2.Assert(); !added {
+		t.Fatal("re-assertion after retraction not added")
+	}
+}
+
+// mapStore is a Store that is not a Snapshotter and that uses scan hints.
+type mapStore struct {
+	db      map[string]*Clause
+	scanned int
+	fail    bool
+}
+
+func (s *mapStore) Insert(tag string, c *Clause) (bool, error) {
+	if _, ok := s.db[tag]; ok {
+		return false, nil
+	}
+	s.db[tag] = c
+	return true, nil
+}
+
+func (s *mapStore) Delete(tag string) (*Clause, error) {
+	c := s.db[tag]
+	delete(s.db, tag)
+	return c, nil
+}
+
+func (s *mapStore) Scan(bound []Term, fn func(c *Clause)) error {
+	if s.fail {
+		return errors.New("scan failed")
+	}
+	for _, c := range s.db {
+		if len(bound) > 0 && bound[0] != nil && c.Head.Arg[0] != bound[0] && !c.Head.Arg[0].Variable() {
+			continue
+		}
+		s.scanned++
+		fn(c)
+	}
+	return nil
+}
+
+func TestStore(t *testing.T) {
+	store := &mapStore{db: make(map[string]*Clause)}
+	parent := new(DBPred)
+	parent.SetArity(2)
+	parent.SetStore(store)
+
+	alice := new(DistinctConst)
+	bob := new(DistinctConst)
+	carol := new(DistinctConst)
+	x := new(DistinctVar)
+
+	for _, c := range []*Clause{
+		NewClause(NewLiteral(parent, alice, bob)),
+		NewClause(NewLiteral(parent, bob, carol)),
+		NewClause(NewLiteral(parent, carol, alice)),
+		NewClause(NewLiteral(parent, alice, bob)),
+	} {
+		if _, err := c.Assert(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	if len(store.db) != 3 {
+		t.Fatalf("expected 3 clauses in store, got %d", len(store.db))
+	}
+
+	// Bound arguments are passed to the store as hints.
+	if ans := NewLiteral(parent, bob, x).Query(); len(ans) != 1 || ans[0].Arg[1] != carol {
+		t.Fatalf("unexpected answer: %v", ans)
+	}
+	if store.scanned != 1 {
+		t.Fatalf("expected 1 clause scanned, got %d", store.scanned)
+	}
+
+	// Stores that are not Snapshotters are copied by snapshots.
+	snap := NewSnapshot(parent)
+	if removed, _ := NewClause(NewLiteral(parent, bob, carol)).Retract(); len(removed) != 1 {
+		t.Fatalf("unexpected retraction: %v", removed)
+	}
+	if ans := snap.Query(NewLiteral(parent, x, carol)); len(ans) != 1 {
+		t.Fatalf("unexpected snapshot answer: %v", ans)
+	}
+	if ans := NewLiteral(parent, x, carol).Query(); len(ans) != 0 {
+		t.Fatalf("unexpected answer: %v", ans)
+	}
+	if removed, _ := NewLiteral(parent, alice, x).RetractMatching(); len(removed) != 1 {
+		t.Fatalf("unexpected retraction: %v", removed)
+	}
+	if removed, _ := parent.Clear(); len(removed) != 1 || len(store.db) != 0 {
+		t.Fatalf("unexpected clear: %v", removed)
+	}
+
+	// Errors during search are reported by queries, including queries against
+	// snapshots of stores that fail.
+	store.fail = true
+	if ans, err := NewLiteral(parent, x, carol).QueryErr(); err == nil || len(ans) != 0 {
+		t.Fatalf("unexpected answer: %v, %v", ans, err)
+	}
+	if _, err := NewSnapshot(parent).QueryErr(NewLiteral(parent, x, carol)); err == nil {
+		t.Fatal("snapshot error not reported")
+	}
+	if _, err := parent.Clauses(); err == nil {
+		t.Fatal("scan error not reported")
+	}
+}
+
+// succPred relates constants to their successors, and requires its first
+// argument to be bound.
+type succPred struct {
+	DistinctPred
+	next  map[Term]Const
+	eager int // searches with the second argument unbound
+}
+
+func (p *succPred) Modes() []Mode {
+	return []Mode{{Pattern: "bf", Cost: 0.1}}
+}
+
+func (p *succPred) Assert(c *Clause) (bool, error) {
+	return false, errors.New("can't assert")
+}
+
+func (p *succPred) Retract(c *Clause) ([]*Clause, error) {
+	return nil, errors.New("can't retract")
+}
+
+func (p *succPred) Search(target *Literal, discovered func(c *Clause)) {
+	if target.Arg[1].Variable() {
+		p.eager++
+	}
+	if next, ok := p.next[target.Arg[0]]; ok {
+		discovered(NewClause(NewLiteral(p, target.Arg[0], next)))
+	}
+}
+
+func TestModes(t *testing.T) {
+	num := new(DBPred)
+	num.SetArity(1)
+	big := new(DBPred)
+	big.SetArity(1)
+	pair := new(DBPred)
+	pair.SetArity(2)
+	next := new(DBPred)
+	next.SetArity(2)
+
+	one := new(DistinctConst)
+	two := new(DistinctConst)
+	three := new(DistinctConst)
+	succ := &succPred{next: map[Term]Const{one: two, two: three}}
+	succ.SetArity(2)
+
+	x := new(DistinctVar)
+	y := new(DistinctVar)
+
+	for _, c := range []Const{one, two, three} {
+		if _, err := NewClause(NewLiteral(num, c)).Assert(); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	// big(Y) :- succ(X, Y), num(X)
+	rule := NewClause(NewLiteral(big, y), NewLiteral(succ, x, y), NewLiteral(num, x))
+	if _, err := rule.Assert(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ans := NewLiteral(big, x).Query(); len(ans) != 2 {
+		t.Fatalf("unexpected answer: %v", ans)
+	}
+
+	// big(X) :- succ(Y, X) is unsafe, since Y is never bound.
+	rule = NewClause(NewLiteral(big, x), NewLiteral(succ, y, x))
+	if rule.Safe() {
+		t.Fatal("unsafe rule not detected")
+	}
+	if _, err := rule.Assert(); err == nil {
+		t.Fatal("unsafe rule asserted")
+	}
+
+	// next(X, Y) :- succ(X, Y) is safe, but only queries that bind X succeed.
+	rule = NewClause(NewLiteral(next, x, y), NewLiteral(succ, x, y))
+	if _, err := rule.Assert(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ans, err := NewLiteral(next, one, x).QueryErr(); err != nil || len(ans) != 1 {
+		t.Fatalf("unexpected answer: %v, %v", ans, err)
+	}
+	if _, err := NewLiteral(next, x, y).QueryErr(); err == nil {
+		t.Fatal("expected error")
+	} else if !strings.Contains(err.Error(), "(_, _): arguments are never bound") {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if ans := NewLiteral(next, x, y).Query(); len(ans) != 0 {
+		t.Fatalf("unexpected answer: %v", ans)
+	}
+	if _, err := NewSnapshot(next).QueryErr(NewLiteral(next, x, y)); err == nil {
+		t.Fatal("expected error from snapshot")
+	}
+
+	// pair(X, Y) :- num(X), num(Y), succ(X, Y) searches succ before num(Y),
+	// since it costs less.
+	rule = NewClause(NewLiteral(pair, x, y), NewLiteral(num, x), NewLiteral(num, y), NewLiteral(succ, x, y))
+	if _, err := rule.Assert(); err != nil {
+		t.Fatal(err.Error())
+	}
+	succ.eager = 0
+	if ans := NewLiteral(pair, x, y).Query(); len(ans) != 2 {
+		t.Fatalf("unexpected answer: %v", ans)
+	}
+	if succ.eager == 0 {
+		t.Fatal("expected cheaper literal to be searched first")
+	}
+}
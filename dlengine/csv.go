@@ -0,0 +1,327 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlengine
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/kevinawalsh/datalog"
+)
+
+// CSVOptions holds options for importing and exporting facts as comma- or
+// tab-separated values.
+type CSVOptions struct {
+	// Comma is the field delimiter. If zero, it is inferred from the file name
+	// for .input and .output directives: a tab for .tsv and .tab files, and a
+	// comma otherwise. For ImportCSV and ExportCSV, a comma is used.
+	Comma rune
+
+	// Comment, if not zero, marks lines to be ignored on import.
+	Comment rune
+
+	// Header indicates that the first row holds column names. It is skipped on
+	// import. On export, the names of the query's variables are written.
+	Header bool
+
+	// LazyQuotes allows, on import, a quote to appear in an unquoted field and
+	// a non-doubled quote to appear in a quoted field.
+	LazyQuotes bool
+
+	// Strings causes every field to be imported as a Quoted string. Otherwise,
+	// fields that are integers, like 42, are imported as Number, fields that
+	// are valid identifiers, like alice, are imported as Ident, and all others
+	// as Quoted.
+	Strings bool
+
+	// Columns, if not nil, maps variables to columns on import: the i-th
+	// distinct variable in the pattern takes its value from column Columns[i],
+	// counting from zero. Otherwise, it takes its value from column i.
+	Columns []int
+}
+
+// ImportCSV reads comma-separated values from r and asserts one fact per row.
+// The pattern is a literal, e.g. parent(X, Y), whose distinct variables take
+// their values from the columns of each row, in order of first appearance
+// (see CSVOptions.Columns). Constants in the pattern appear unchanged in every
+// fact. The result reports how many facts were new and how many were already
+// known. If opts is nil, default options are used.
+func (e *Engine) ImportCSV(r io.Reader, pattern string, opts *CSVOptions) (added, known int, err error) {
+	literal, err := parsePattern(pattern)
+	if err != nil {
+		return 0, 0, err
+	}
+	return e.importCSV(r, literal, csvOptions(opts, ""), nil)
+}
+
+// ExportCSV executes the query, e.g. ancestor(alice, X), and writes one row of
+// comma-separated values to w for each answer, holding the values of the
+// query's distinct variables in order of first appearance. Rows are sorted.
+// The number of rows is returned. If opts is nil, default options are used.
+func (e *Engine) ExportCSV(w io.Writer, query string, opts *CSVOptions) (int, error) {
+	literal, err := parsePattern(query)
+	if err != nil {
+		return 0, err
+	}
+	return e.exportCSV(w, literal, csvOptions(opts, ""))
+}
+
+// parsePattern parses a string holding a single literal, which may be
+// followed by '?'.
+func parsePattern(pattern string) (*literalNode, error) {
+	node, err := parseQuery(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if node.assumed != nil {
+		return nil, fmt.Errorf("datalog: expecting literal: %s", pattern)
+	}
+	return node.literal, nil
+}
+
+// csvOptions returns a copy of opts, or default options if opts is nil, with
+// the delimiter inferred from file if necessary.
+func csvOptions(opts *CSVOptions, file string) CSVOptions {
+	var o CSVOptions
+	if opts != nil {
+		o = *opts
+	}
+	if o.Comma == 0 {
+		switch strings.ToLower(filepath.Ext(file)) {
+		case ".tsv", ".tab":
+			o.Comma = '\t'
+		default:
+			o.Comma = ','
+		}
+	}
+	return o
+}
+
+// patternVars returns, for each argument of literal, the index of the distinct
+// variable found there, or -1 for constants. The number of distinct variables
+// is also returned.
+func patternVars(literal *literalNode) ([]int, int) {
+	index := make(map[string]int)
+	slots := make([]int, len(literal.nodeList))
+	for i, n := range literal.nodeList {
+		leaf := n.(*leafNode)
+		if leaf.nodeType != nodeVariable {
+			slots[i] = -1
+			continue
+		}
+		k, ok := index[leaf.val]
+		if !ok {
+			k = len(index)
+			index[leaf.val] = k
+		}
+		slots[i] = k
+	}
+	return slots, len(index)
+}
+
+// importCSV asserts one fact for each row read from r. If added is not nil, it
+// is called for each new fact.
+func (e *Engine) importCSV(r io.Reader, pattern *literalNode, opts CSVOptions, added func(*clauseNode) error) (n, known int, err error) {
+	slots, nvars := patternVars(pattern)
+	columns := opts.Columns
+	if columns == nil {
+		columns = make([]int, nvars)
+		for i := range columns {
+			columns[i] = i
+		}
+	} else if len(columns) != nvars {
+		return 0, 0, fmt.Errorf("datalog: pattern has %d variables, but %d columns given", nvars, len(columns))
+	}
+	in := csv.NewReader(r)
+	in.Comma = opts.Comma
+	in.Comment = opts.Comment
+	in.LazyQuotes = opts.LazyQuotes
+	in.FieldsPerRecord = -1
+	if opts.Header {
+		if _, err := in.Read(); err == io.EOF {
+			return 0, 0, nil
+		} else if err != nil {
+			return 0, 0, err
+		}
+	}
+	for {
+		row, err := in.Read()
+		if err == io.EOF {
+			return n, known, nil
+		} else if err != nil {
+			return n, known, err
+		}
+		literal := newLiteral(pattern.pos, pattern.predsym)
+		for i, k := range slots {
+			if k < 0 {
+				literal.append(pattern.nodeList[i])
+				continue
+			}
+			col := columns[k]
+			if col < 0 || col >= len(row) {
+				line, _ := in.FieldPos(0)
+				return n, known, fmt.Errorf("datalog: line %d: missing column %d", line, col)
+			}
+			literal.append(fieldLeaf(pattern.pos, row[col], opts.Strings))
+		}
+		clause := newClause(pattern.pos, literal)
+		ok, err := e.assert(clause)
+		if err != nil {
+			return n, known, err
+		}
+		if !ok {
+			known++
+			continue
+		}
+		n++
+		if added != nil {
+			if err := added(clause); err != nil {
+				return n, known, err
+			}
+		}
+	}
+}
+
+// fieldLeaf returns a constant for the given field.
+func fieldLeaf(pos pos, field string, quoted bool) *leafNode {
+	if !quoted {
+		if n, ok := isNumber(field); ok {
+			return newLeaf(nodeNumber, pos, n)
+		}
+		if isIdent(field) {
+			return newLeaf(nodeIdentifier, pos, field)
+		}
+	}
+	return newLeaf(nodeString, pos, field)
+}
+
+// isNumber checks whether s would be lexed as a single number, and if so,
+// returns it in canonical form.
+func isNumber(s string) (string, bool) {
+	l := lex("", s)
+	t := l.nextToken()
+	if t.typ != itemNumber || t.val != s || l.nextToken().typ != itemEOF {
+		return "", false
+	}
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return strconv.FormatInt(n, 10), true
+}
+
+// isIdent checks whether s would be lexed as a single identifier.
+func isIdent(s string) bool {
+	l := lex("", s)
+	t := l.nextToken()
+	return t.typ == itemIdentifier && t.val == s && l.nextToken().typ == itemEOF
+}
+
+// exportCSV writes one row to w for each answer to the query.
+func (e *Engine) exportCSV(w io.Writer, query *literalNode, opts CSVOptions) (int, error) {
+	l, _ := e.recoverQuery(newQuery(query.pos, query, nil), true)
+	a, err := l.QueryErr()
+	if err != nil {
+		return 0, err
+	}
+	slots, nvars := patternVars(query)
+	var header []string
+	pos := make([]int, nvars) // position of first appearance of each variable
+	for i, k := range slots {
+		if k == len(header) {
+			header = append(header, query.nodeList[i].(*leafNode).val)
+			pos[k] = i
+		}
+	}
+	rows := make([][]string, len(a))
+	for i, fact := range a {
+		rows[i] = make([]string, nvars)
+		for k, p := range pos {
+			rows[i][k] = termValue(fact.Arg[p])
+		}
+	}
+	sort.Sort(csvRows(rows))
+	out := csv.NewWriter(w)
+	out.Comma = opts.Comma
+	if opts.Header {
+		out.Write(header)
+	}
+	out.WriteAll(rows)
+	return len(rows), out.Error()
+}
+
+// termValue returns the value of a constant, without quotes.
+func termValue(t datalog.Term) string {
+	switch t := t.(type) {
+	case *Ident:
+		return t.Value
+	case *Quoted:
+		return t.Value
+	default:
+		return fmt.Sprintf("%v", t)
+	}
+}
+
+// csvRows implements sort.Interface.
+type csvRows [][]string
+
+func (r csvRows) Len() int      { return len(r) }
+func (r csvRows) Swap(i, j int) { r[i], r[j] = r[j], r[i] }
+func (r csvRows) Less(i, j int) bool {
+	for k := range r[i] {
+		if r[i][k] != r[j][k] {
+			return r[i][k] < r[j][k]
+		}
+	}
+	return false
+}
+
+// directive executes an .input or .output directive, returning the number of
+// facts added or rows written. For .input, the number of facts that were
+// already known is also returned, and added, if not nil, is called for each new
+// fact. Directives are executed only if e.Directives is set.
+func (e *Engine) directive(node *directiveNode, added func(*clauseNode) error) (n, known int, err error) {
+	if !e.Directives {
+		return 0, 0, ErrDirectives
+	}
+	file := filepath.Clean(node.file)
+	if filepath.IsAbs(file) || file == ".." || strings.HasPrefix(file, ".."+string(filepath.Separator)) {
+		return 0, 0, fmt.Errorf("datalog: file %q is outside of the directory", node.file)
+	}
+	if e.Dir != "" {
+		file = filepath.Join(e.Dir, file)
+	}
+	opts := csvOptions(e.CSV, file)
+	if node.directive == "input" {
+		f, err := os.Open(file)
+		if err != nil {
+			return 0, 0, err
+		}
+		defer f.Close()
+		return e.importCSV(f, node.literal, opts, added)
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return 0, 0, err
+	}
+	n, err = e.exportCSV(f, node.literal, opts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return n, 0, err
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlengine
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestImportExportCSV(t *testing.T) {
+	e := NewEngine()
+	in := "parent,child\nalice,bob\nbob,\"Carol Smith\"\n# comment\nbob,42\nalice,bob\n"
+	added, known, err := e.ImportCSV(strings.NewReader(in), "parent(X, Y)",
+		&CSVOptions{Header: true, Comment: '#'})
+	if err != nil || added != 3 || known != 1 {
+		t.Fatalf("unexpected import: %d, %d, %v", added, known, err)
+	}
+	for _, q := range []string{`parent(alice, bob)`, `parent(bob, "Carol Smith")`, `parent(bob, 42)`} {
+		if a, err := e.Query(q); err != nil || len(a) != 1 {
+			t.Fatalf("unexpected answer for %s: %v, %v", q, a, err)
+		}
+	}
+
+	// Columns can be reordered, and constants added.
+	in = "bob\talice\tx\n"
+	added, _, err = e.ImportCSV(strings.NewReader(in), `edge(A, B, road)`,
+		&CSVOptions{Comma: '\t', Columns: []int{1, 0}, Strings: true})
+	if err != nil || added != 1 {
+		t.Fatalf("unexpected import: %d, %v", added, err)
+	}
+	if a, err := e.Query(`edge("alice", "bob", road)`); err != nil || len(a) != 1 {
+		t.Fatalf("unexpected answer: %v, %v", a, err)
+	}
+	if _, _, err := e.ImportCSV(strings.NewReader("a\n"), `edge(A, B, road)`, nil); err == nil {
+		t.Fatal("missing column not detected")
+	}
+
+	var out bytes.Buffer
+	e.Batch("test", `ancestor(X, Y) :- parent(X, Y). ancestor(X, Z) :- ancestor(X, Y), ancestor(Y, Z).`)
+	n, err := e.ExportCSV(&out, `ancestor(alice, X)`, &CSVOptions{Header: true})
+	if err != nil || n != 3 {
+		t.Fatalf("unexpected export: %d, %v", n, err)
+	}
+	if s := out.String(); s != "X\n42\nCarol Smith\nbob\n" {
+		t.Fatalf("unexpected export:\n%s", s)
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	err = ioutil.WriteFile(filepath.Join(dir, "parent.csv"), []byte("alice,bob\nbob,carol\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := NewEngine()
+	e.Directives = true
+	e.Dir = dir
+	a, r, q, errs := e.Process("test", `
+		.input parent(X, Y) "parent.csv"
+		ancestor(X, Y) :- parent(X, Y).
+		ancestor(X, Z) :- ancestor(X, Y), ancestor(Y, Z).
+		.output ancestor(X, Y) "ancestor.tsv"
+		.input missing(X) "missing.csv"
+		`)
+	if a != 2 || r != 0 || q != 0 || errs != 1 {
+		t.Fatalf("unexpected process result: %d %d %d %d", a, r, q, errs)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "ancestor.tsv"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := string(data); s != "alice\tbob\nalice\tcarol\nbob\tcarol\n" {
+		t.Fatalf("unexpected output:\n%s", s)
+	}
+
+	// Batch counts facts read by .input as assertions.
+	e = NewEngine()
+	e.Directives = true
+	e.Dir = dir
+	if n, _, err := e.Batch("test", `.input parent(X, Y) "parent.csv"`); err != nil || n != 2 {
+		t.Fatalf("unexpected batch result: %d, %v", n, err)
+	}
+
+	// Facts read by .input into a Durable engine are logged.
+	d := openDurable(t, filepath.Join(dir, "durable"), nil)
+	d.Engine().Directives = true
+	d.Engine().Dir = dir
+	if n, _, err := d.Batch("test", `.input parent(X, Y) "parent.csv"`); err != nil || n != 2 {
+		t.Fatalf("unexpected batch result: %d, %v", n, err)
+	}
+	d.Close()
+	d = openDurable(t, filepath.Join(dir, "durable"), nil)
+	if a, err := d.Query("parent(X, Y)"); err != nil || len(a) != 2 {
+		t.Fatalf("unexpected answer: %v, %v", a, err)
+	}
+	d.Close()
+
+	// Directives are disabled by default.
+	e = NewEngine()
+	e.Dir = dir
+	if _, _, err := e.Batch("test", `.input parent(X, Y) "parent.csv"`); err != ErrDirectives {
+		t.Fatalf("expected ErrDirectives, got %v", err)
+	}
+
+	// Files outside of the directory are rejected.
+	e.Directives = true
+	for _, file := range []string{filepath.Join(dir, "parent.csv"), "../parent.csv", "sub/../../parent.csv"} {
+		input := fmt.Sprintf(".output parent(X, Y) %q", file)
+		if _, _, err := e.Batch("test", input); err == nil {
+			t.Fatalf("%s: expected error", input)
+		}
+	}
+}
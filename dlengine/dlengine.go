@@ -20,11 +20,16 @@
 package dlengine
 
 import (
+	"errors"
 	"fmt"
+	"io"
+	"os"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/kevinawalsh/datalog"
+	"github.com/kevinawalsh/datalog/dlprim"
 )
 
 // Var represents a variable with a name, e.g. X, Y. Name should start with
@@ -53,12 +58,23 @@ func (q *Quoted) String() string {
 	return strconv.Quote(q.Value)
 }
 
+// StringValue returns the value of q. This allows dlprim primitives like
+// dlprim.Concat to work on quoted strings.
+func (q *Quoted) StringValue() string {
+	return q.Value
+}
+
+// IsIdent returns false.
+func (q *Quoted) IsIdent() bool {
+	return false
+}
+
 // NewQuoted returns a Quoted with the given value.
 func NewQuoted(value string) *Quoted {
 	return &Quoted{Value: value}
 }
 
-// Ident represents a bare identifier constant, e.g. alice, -42. Value should
+// Ident represents a bare identifier constant, e.g. alice, x7. Value should
 // start with non-uppercase and follow traditional datalog syntax.
 type Ident struct {
 	Value string
@@ -69,11 +85,44 @@ func (i *Ident) String() string {
 	return i.Value
 }
 
+// StringValue returns the value of i. This allows dlprim primitives like
+// dlprim.Concat to work on identifiers.
+func (i *Ident) StringValue() string {
+	return i.Value
+}
+
+// IsIdent returns true.
+func (i *Ident) IsIdent() bool {
+	return true
+}
+
 // NewIdent returns an Ident with the given value.
 func NewIdent(value string) *Ident {
 	return &Ident{Value: value}
 }
 
+// Number represents an integer constant, e.g. 7, -42. Numbers are written in
+// canonical form, so 007 and 7 are the same constant.
+type Number struct {
+	Value int64
+	datalog.DistinctConst
+}
+
+func (n *Number) String() string {
+	return strconv.FormatInt(n.Value, 10)
+}
+
+// Int64 returns the value of n. This allows dlprim primitives like dlprim.Less
+// to compare numbers.
+func (n *Number) Int64() int64 {
+	return n.Value
+}
+
+// NewNumber returns a Number with the given value.
+func NewNumber(value int64) *Number {
+	return &Number{Value: value}
+}
+
 // Pred represents a database-defined predicate with a name and arity, e.g.
 // ancestor/2. Name should start with non-uppercase and follow traditional
 // datalog syntax.
@@ -99,77 +148,286 @@ func NewRule(head *datalog.Literal, body ...*datalog.Literal) *datalog.Clause {
 }
 
 // Engine maintains state for the datalog prover. The main task of the engine is
-// to map a given piece of text to existing Var, Ident, Quoted, and Pred
+// to map a given piece of text to existing Var, Ident, Quoted, Number, and Pred
 // objects. Because go does not provide weak references, reference counting is
 // needed to ensure that objects that are no longer used are removed from the
-// Engine to be garbage collected.
+// Engine to be garbage collected. Terms are indexed by their datalog syntax,
+// e.g. alice, "Alice", or X, and predicates by name and arity, e.g. parent/2.
 type Engine struct {
 	Term     map[string]datalog.Term // live variables, constants, and identifiers
 	Pred     map[string]datalog.Pred // live predicates
 	refCount map[interface{}]int     // all refcounted objects
+	mu       sync.RWMutex            // guards Term, Pred, and refCount
+
+	// StrictRetract, if set, causes the engine to report ErrNotFound for any
+	// retraction that does not remove at least one clause.
+	StrictRetract bool
+
+	// Directives, if set, enables .input and .output directives, which read
+	// and write files. Otherwise, they fail with ErrDirectives. Since the
+	// directives can create files, they should be enabled only for trusted
+	// input.
+	Directives bool
+
+	// Dir, if set, is the directory that holds the files named in .input and
+	// .output directives. Otherwise, the current directory is used. File names
+	// must be relative, and must not refer to files outside of this directory.
+	Dir string
+
+	// CSV, if set, holds options for .input and .output directives.
+	CSV *CSVOptions
+
+	// Out, if set, receives the output of Process. Otherwise, os.Stdout is
+	// used.
+	Out io.Writer
+
+	// Formatter, if set, formats the output of Process. Otherwise, a
+	// TextFormatter is used.
+	Formatter Formatter
 }
 
-// NewEngine constructs a new engine.
+// ErrNotFound is reported for retractions that remove nothing when
+// Engine.StrictRetract is set.
+var ErrNotFound = errors.New("datalog: no matching clause to retract")
+
+// ErrDirectives is reported for .input and .output directives unless
+// Engine.Directives is set.
+var ErrDirectives = errors.New("datalog: .input and .output directives are disabled")
+
+// NewEngine constructs a new engine. The primitives dlprim.Equals,
+// dlprim.NotEquals, dlprim.Less, dlprim.LessOrEqual, dlprim.Greater, and
+// dlprim.GreaterOrEqual are added to the engine, for use with the infix
+// operators '=', '!=', '<', '<=', '>', and '>='. So are instances of the
+// arithmetic primitives dlprim.Plus, dlprim.Minus, dlprim.Times, dlprim.Div,
+// and dlprim.Mod, for use with '+', '-', '*', '/', and 'mod'.
 func NewEngine() *Engine {
-	return &Engine{
+	e := &Engine{
 		Term:     make(map[string]datalog.Term),
 		Pred:     make(map[string]datalog.Pred),
 		refCount: make(map[interface{}]int),
 	}
+	e.AddPred(dlprim.Equals)
+	e.AddPred(dlprim.NotEquals)
+	e.AddPred(dlprim.Less)
+	e.AddPred(dlprim.LessOrEqual)
+	e.AddPred(dlprim.Greater)
+	e.AddPred(dlprim.GreaterOrEqual)
+	e.AddPred(dlprim.Plus)
+	e.AddPred(dlprim.Minus)
+	e.AddPred(dlprim.Times)
+	e.AddPred(dlprim.Div)
+	e.AddPred(dlprim.Mod)
+	return e
+}
+
+// NewInteger returns the engine's Number constant with value v, adding it to
+// the engine if necessary. This allows primitives like dlprim.Plus to produce
+// the same constants the engine uses.
+func (e *Engine) NewInteger(v int64) dlprim.Integer {
+	key := strconv.FormatInt(v, 10)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if n, ok := e.Term[key].(*Number); ok {
+		return n
+	}
+	n := NewNumber(v)
+	if _, ok := e.Term[key]; !ok {
+		e.Term[key] = n
+	}
+	return n
+}
+
+// NewString returns the engine's Ident constant with value v, if ident is set
+// and v is a valid identifier, or its Quoted constant with value v otherwise,
+// adding it to the engine if necessary. Together with NewInteger, this allows
+// primitives like dlprim.Concat to produce the same constants the engine uses.
+func (e *Engine) NewString(v string, ident bool) dlprim.StringConst {
+	var key string
+	var c dlprim.StringConst
+	if ident && isIdent(v) {
+		key, c = v, NewIdent(v)
+	} else {
+		key, c = strconv.Quote(v), NewQuoted(v)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if t, ok := e.Term[key].(dlprim.StringConst); ok {
+		return t
+	}
+	if _, ok := e.Term[key]; !ok {
+		e.Term[key] = c
+	}
+	return c
 }
 
 // AddPred add the given predicate to the engine. This can be used to add custom
 // predicates like dlprim.Equals to the engine. It can also be used to add the
 // same predicate to multiple engines (they will then share state for that
-// predicate). Any previous predicate with same name is replaced.
+// predicate). Any previous predicate with same name is replaced. If p is a
+// dlprim.FactoryPred, like dlprim.Concat, then p.WithFactory(e) is added
+// instead, so the constants it discovers are the engine's own. Such predicates
+// are copied for each engine, so e.Pred holds the copy rather than p, and
+// engines don't share state for them.
 func (e *Engine) AddPred(p datalog.Pred) {
+	if fp, ok := p.(dlprim.FactoryPred); ok {
+		p = fp.WithFactory(e)
+	}
 	id := fmt.Sprintf("%v", p) + "/" + strconv.Itoa(p.Arity())
+	e.mu.Lock()
 	e.Pred[id] = p
+	e.mu.Unlock()
 }
 
 // Process parses and executes the input string, returning the number of
 // assertions, retractions, queries, and errors that were seen. This function
-// prints a log of operations to stdout. When errors are printed, a message is
-// printed to stdout, with name is shown as the name of the input source, then
-// processing continues if possible.
+// writes a log of operations, including the answers to queries, to e.Out
+// using e.Formatter. When errors are written, name is shown as the name of the
+// input source, then processing continues if possible. If the input has syntax
+// errors, each one is reported and nothing is executed.
 func (e *Engine) Process(name, input string) (assertions, retractions, queries, errors int) {
+	w, f := e.output()
+	e.process(name, input, func(r *Result) {
+		switch r.Kind {
+		case StmtAssert:
+			assertions++
+		case StmtRetract, StmtRetractMatching:
+			retractions++
+		case StmtQuery:
+			queries++
+		}
+		if r.Err != nil {
+			errors++
+		}
+		f.Format(w, r)
+	})
+	return
+}
+
+// ProcessResults parses and executes the input string, like Process, but
+// returns the result of each statement instead of writing a log. Processing
+// continues after errors if possible. If the input can't be parsed, nothing is
+// executed, and a result of kind StmtInvalid is returned for each syntax error.
+func (e *Engine) ProcessResults(name, input string) []*Result {
+	var results []*Result
+	e.process(name, input, func(r *Result) {
+		results = append(results, r)
+	})
+	return results
+}
+
+// process parses and executes the input string, calling fn with the result of
+// each statement.
+func (e *Engine) process(name, input string, fn func(*Result)) {
 	pgm, err := parse(name, input)
 	if err != nil {
-		errors++
-		fmt.Printf("datalog: %s", err.Error())
+		for _, err := range err.(ParseErrors) {
+			fn(&Result{Kind: StmtInvalid, Source: name, Pos: err.Offset, Line: err.Line, Col: err.Col, Err: err})
+		}
 		return
 	}
 	for _, node := range pgm.nodeList {
-		switch node := node.(type) {
-		case *actionNode:
-			if node.action == actionAssert {
-				err = e.assert(node.clause, true)
-				assertions++
-			} else {
-				err = e.retract(node.clause, true)
-				retractions++
+		fn(e.run(name, node))
+	}
+}
+
+// output returns the writer and formatter to be used by Process.
+func (e *Engine) output() (io.Writer, Formatter) {
+	var w io.Writer = os.Stdout
+	if e.Out != nil {
+		w = e.Out
+	}
+	var f Formatter = TextFormatter{}
+	if e.Formatter != nil {
+		f = e.Formatter
+	}
+	return w, f
+}
+
+// run executes a statement, returning the result.
+func (e *Engine) run(name string, n node) *Result {
+	p := n.Position()
+	r := &Result{Source: name, Pos: p.offset, Line: p.line, Col: p.col, Text: n.String()}
+	switch n := n.(type) {
+	case *actionNode:
+		r.Clause = e.recoverClause(n.clause)
+		switch n.action {
+		case actionAssert:
+			r.Kind = StmtAssert
+			var added bool
+			added, r.Err = e.assertClause(r.Clause)
+			if added {
+				r.Count = 1
+			} else if r.Err == nil {
+				r.Known = 1
 			}
-		case *queryNode:
-			err = e.query(node.literal)
-			queries++
-		default:
-			panic("not reached")
+		case actionRetract:
+			r.Kind = StmtRetract
+			r.Count, r.Err = e.retractClause(r.Clause, n.action, e.StrictRetract)
+		case actionRetractMatching:
+			r.Kind = StmtRetractMatching
+			r.Count, r.Err = e.retractClause(r.Clause, n.action, e.StrictRetract)
 		}
-		if err != nil {
-			fmt.Printf("datalog: %s:%d: %s\n", name, node.Position(), err.Error())
-			errors++
-		} else {
-			fmt.Printf("OK\n")
+	case *queryNode:
+		r.Kind = StmtQuery
+		r.Query, r.Assumed = e.recoverQuery(n, true)
+		if n.assumed == nil {
+			r.Assumed = nil
 		}
+		r.Answers, r.Err = r.Query.QueryAssuming(r.Assumed...)
+	case *directiveNode:
+		r.Kind = StmtInput
+		if n.directive == "output" {
+			r.Kind = StmtOutput
+		}
+		r.Count, r.Known, r.Err = e.directive(n, nil)
+	default:
+		panic("not reached")
 	}
-	return
+	return r
 }
 
 // Batch parses and executes the input string, returning the number of
-// assertions and retractions processed. Only assertions and retractions are
-// processed. Queries are ignored. Nothing is printed to stdout, and execution
-// stops if any error is encountered.
+// assertions and retractions processed. Only assertions, retractions, and
+// directives are processed, with each fact read by an .input directive counted
+// as an assertion. Queries are ignored. Nothing is printed to stdout, and
+// execution stops if any error is encountered. If the input has syntax errors,
+// nothing is executed, and all of the errors are returned together as
+// ParseErrors.
 func (e *Engine) Batch(name, input string) (assertions, retractions int, err error) {
+	added, known, retractions, err := e.batch(name, input, e.StrictRetract, nil)
+	return added + known, retractions, err
+}
+
+// BatchQueries is like Batch, but queries are also executed, in order with the
+// other statements. A result of kind StmtQuery is returned for each query, in
+// the order the queries appear in the input, giving the position of the query
+// and its answers. As with Batch, execution stops if any error is encountered,
+// and the results of queries executed before the error are returned.
+func (e *Engine) BatchQueries(name, input string) ([]*Result, error) {
+	var results []*Result
+	_, _, _, err := e.batch(name, input, e.StrictRetract, func(node *queryNode) error {
+		r := e.run(name, node)
+		if r.Err != nil {
+			return r.Err
+		}
+		results = append(results, r)
+		return nil
+	})
+	return results, err
+}
+
+// Load is like Batch, but it reports how many assertions added new facts or
+// rules to the database and how many were already known, e.g. because the same
+// input was loaded before.
+func (e *Engine) Load(name, input string) (added, known int, err error) {
+	added, known, _, err = e.batch(name, input, e.StrictRetract, nil)
+	return
+}
+
+// batch executes the input string, stopping at the first error. Queries are
+// passed to query, or ignored if query is nil. If strict is set, retractions
+// that remove nothing are errors (see StrictRetract).
+func (e *Engine) batch(name, input string, strict bool, query func(*queryNode) error) (added, known, retractions int, err error) {
 	pgm, err := parse(name, input)
 	if err != nil {
 		return
@@ -178,14 +436,28 @@ func (e *Engine) Batch(name, input string) (assertions, retractions int, err err
 		switch node := node.(type) {
 		case *actionNode:
 			if node.action == actionAssert {
-				err = e.assert(node.clause, false)
-				assertions++
+				var ok bool
+				ok, err = e.assert(node.clause)
+				if ok {
+					added++
+				} else if err == nil {
+					known++
+				}
 			} else {
-				err = e.retract(node.clause, false)
+				_, err = e.retract(node.clause, node.action, strict)
 				retractions++
 			}
 		case *queryNode:
-			// ignore
+			if query != nil {
+				err = query(node)
+			}
+		case *directiveNode:
+			var n, k int
+			n, k, err = e.directive(node, nil)
+			if node.directive == "input" {
+				added += n
+				known += k
+			}
 		default:
 			panic("not reached")
 		}
@@ -196,77 +468,135 @@ func (e *Engine) Batch(name, input string) (assertions, retractions int, err err
 	return
 }
 
-func (e *Engine) assert(clause *clauseNode, interactive bool) error {
-	c := e.recoverClause(clause)
-	if interactive {
-		fmt.Printf("Assert: %s\n", c)
-	}
-	err := c.Assert()
-	e.track(c, +1)
-	return err
+func (e *Engine) assert(clause *clauseNode) (bool, error) {
+	return e.assertClause(e.recoverClause(clause))
 }
 
-func (e *Engine) retract(clause *clauseNode, interactive bool) error {
-	c := e.recoverClause(clause)
-	if interactive {
-		fmt.Printf("Retract: %s\n", c)
+func (e *Engine) assertClause(c *datalog.Clause) (bool, error) {
+	added, err := c.Assert()
+	if added {
+		e.track(c, +1)
 	}
-	err := c.Retract()
-	e.track(c, -1)
-	return err
+	return added, err
+}
+
+func (e *Engine) retract(clause *clauseNode, action actionType, strict bool) (int, error) {
+	return e.retractClause(e.recoverClause(clause), action, strict)
 }
 
-func (e *Engine) query(literal *literalNode) error {
-	l := e.recoverLiteral(literal)
-	fmt.Printf("Query: %s\n", l)
-	a := l.Query()
-	fmt.Println(a)
-	return nil
+func (e *Engine) retractClause(c *datalog.Clause, action actionType, strict bool) (int, error) {
+	var removed []*datalog.Clause
+	var err error
+	if action == actionRetractMatching {
+		removed, err = c.Head.RetractMatching()
+	} else {
+		removed, err = c.Retract()
+	}
+	e.untrack(removed)
+	if err == nil && len(removed) == 0 && strict {
+		err = ErrNotFound
+	}
+	return len(removed), err
 }
 
 // Assert parses the given string and adds the resulting assertion to the
-// database. If assertion does not end in '.', one is added.
-func (e *Engine) Assert(assertion string) error {
+// database, reporting whether it was new. If assertion does not end in '.', one
+// is added.
+func (e *Engine) Assert(assertion string) (bool, error) {
+	node, err := parseAssertion(assertion)
+	if err != nil {
+		return false, err
+	}
+	return e.assert(node.clause)
+}
+
+// parseAssertion parses a string containing a single assertion. If assertion
+// does not end in '.', one is added.
+func parseAssertion(assertion string) (*actionNode, error) {
 	if !strings.HasSuffix(assertion, ".") {
 		assertion += "."
 	}
 	pgm, err := parse("assert", assertion)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if len(pgm.nodeList) != 1 {
-		return fmt.Errorf("datalog: expecting one assertion: %s", assertion)
+		return nil, fmt.Errorf("datalog: expecting one assertion: %s", assertion)
 	}
 	node, ok := pgm.nodeList[0].(*actionNode)
 	if !ok || node.action != actionAssert {
-		return fmt.Errorf("datalog: expecting assertion: %s", assertion)
+		return nil, fmt.Errorf("datalog: expecting assertion: %s", assertion)
 	}
-	return e.assert(node.clause, false)
+	return node, nil
 }
 
 // Retract parses the given string and removes the resulting assertion from the
-// database. If retraction does not end in '~', one is added.
-func (e *Engine) Retract(retraction string) error {
+// database, returning the number of clauses removed. If retraction does not end
+// in '~', one is added. If it ends in '~~', every fact matching the given
+// literal is removed.
+func (e *Engine) Retract(retraction string) (int, error) {
+	node, err := parseRetraction(retraction)
+	if err != nil {
+		return 0, err
+	}
+	return e.retract(node.clause, node.action, e.StrictRetract)
+}
+
+// parseRetraction parses a string containing a single retraction. If
+// retraction does not end in '~', one is added.
+func parseRetraction(retraction string) (*actionNode, error) {
 	if !strings.HasSuffix(retraction, "~") {
 		retraction += "~"
 	}
 	pgm, err := parse("retract", retraction)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if len(pgm.nodeList) != 1 {
-		return fmt.Errorf("datalog: expecting one retraction: %s", retraction)
+		return nil, fmt.Errorf("datalog: expecting one retraction: %s", retraction)
 	}
 	node, ok := pgm.nodeList[0].(*actionNode)
-	if !ok || node.action != actionRetract {
-		return fmt.Errorf("datalog: expecting retraction: %s", retraction)
+	if !ok || node.action == actionAssert {
+		return nil, fmt.Errorf("datalog: expecting retraction: %s", retraction)
+	}
+	return node, nil
+}
+
+// Clear removes all facts and rules for a predicate, returning the number of
+// clauses removed. The predicate is named along with its arity, e.g.
+// "ancestor/2". Custom predicates like dlprim.Equals can't be cleared.
+func (e *Engine) Clear(pred string) (int, error) {
+	e.mu.RLock()
+	p, ok := e.Pred[pred]
+	e.mu.RUnlock()
+	if !ok {
+		return 0, nil
+	}
+	db, ok := p.(interface {
+		Clear() ([]*datalog.Clause, error)
+	})
+	if !ok {
+		return 0, fmt.Errorf("datalog: can't clear custom predicate %s", pred)
 	}
-	return e.retract(node.clause, false)
+	removed, err := db.Clear()
+	e.untrack(removed)
+	return len(removed), err
 }
 
 // Query parses the given string and executes the resulting query. If query does
 // not end in '?', one is added.
 func (e *Engine) Query(query string) (datalog.Answers, error) {
+	node, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	l, assumed := e.recoverQuery(node, true)
+	return l.QueryAssuming(assumed...)
+}
+
+// parseQuery parses a string containing a single query. If query does not end
+// in '?', one is added.
+func parseQuery(query string) (*queryNode, error) {
 	if !strings.HasSuffix(query, "?") {
 		query += "?"
 	}
@@ -281,47 +611,134 @@ func (e *Engine) Query(query string) (datalog.Answers, error) {
 	if !ok {
 		return nil, fmt.Errorf("datalog: expecting query: %s", query)
 	}
-	l := e.recoverLiteral(node.literal)
-	return l.Query(), nil
+	return node, nil
+}
+
+// Snapshot is an immutable view of the database of an Engine. See
+// datalog.Snapshot for details.
+type Snapshot struct {
+	engine *Engine
+	snap   *datalog.Snapshot
+}
+
+// Snapshot takes a snapshot of the engine's database. Queries against the
+// snapshot are not affected by later assertions and retractions, and they can
+// run concurrently with them.
+func (e *Engine) Snapshot() *Snapshot {
+	e.mu.RLock()
+	preds := make([]datalog.Pred, 0, len(e.Pred))
+	for _, p := range e.Pred {
+		preds = append(preds, p)
+	}
+	e.mu.RUnlock()
+	return &Snapshot{e, datalog.NewSnapshot(preds...)}
+}
+
+// Query parses the given string and executes the resulting query against the
+// snapshot. If query does not end in '?', one is added. Names that were not
+// known to the engine are not added to it.
+func (s *Snapshot) Query(query string) (datalog.Answers, error) {
+	node, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	l, assumed := s.engine.recoverQuery(node, false)
+	return s.snap.QueryAssuming(l, assumed...)
 }
 
 // The remainder of this file implements reference counting and uniqueness for
 // literals, constants, etc., used with a given engine.
 
 func (e *Engine) recoverClause(clause *clauseNode) *datalog.Clause {
-	head := e.recoverLiteral(clause.head)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.recoverRule(clause, nil)
+}
+
+// recoverQuery recovers the literal and assumed clauses for a query, taking care
+// of locking. The engine is not modified if intern is false. Caller must not
+// hold e.mu.
+func (e *Engine) recoverQuery(query *queryNode, intern bool) (*datalog.Literal, []*datalog.Clause) {
+	var sc *scope
+	if intern {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+	} else {
+		e.mu.RLock()
+		defer e.mu.RUnlock()
+		sc = newScope()
+	}
+	assumed := make([]*datalog.Clause, len(query.assumed))
+	for i, node := range query.assumed {
+		assumed[i] = e.recoverRule(node.(*clauseNode), sc)
+	}
+	return e.recoverLiteral(query.literal, sc), assumed
+}
+
+// scope holds predicates and terms that are not known to the engine and should
+// not be added to it, e.g. those appearing only in a query against a snapshot.
+type scope struct {
+	term map[string]datalog.Term
+	pred map[string]datalog.Pred
+}
+
+func newScope() *scope {
+	return &scope{make(map[string]datalog.Term), make(map[string]datalog.Pred)}
+}
+
+// recoverRule maps clause to a datalog clause. See recoverLiteral.
+func (e *Engine) recoverRule(clause *clauseNode, sc *scope) *datalog.Clause {
+	head := e.recoverLiteral(clause.head, sc)
 	body := make([]*datalog.Literal, len(clause.nodeList))
 	for i, node := range clause.nodeList {
-		body[i] = e.recoverLiteral(node.(*literalNode))
+		body[i] = e.recoverLiteral(node.(*literalNode), sc)
 	}
 	return NewRule(head, body...)
 }
 
-func (e *Engine) recoverLiteral(literal *literalNode) *datalog.Literal {
+// recoverLiteral maps literal to a datalog literal, using existing objects
+// where possible. New predicates and terms are added to the engine if sc is
+// nil, otherwise they are added to sc. Caller must hold e.mu, for writing if sc
+// is nil.
+func (e *Engine) recoverLiteral(literal *literalNode, sc *scope) *datalog.Literal {
+	preds, terms := e.Pred, e.Term
+	if sc != nil {
+		preds, terms = sc.pred, sc.term
+	}
 	name := literal.predsym
 	arity := len(literal.nodeList)
 	id := name + "/" + strconv.Itoa(arity)
 	p, ok := e.Pred[id]
+	if !ok {
+		p, ok = preds[id]
+	}
 	if !ok {
 		p = NewPred(name, arity)
-		e.Pred[id] = p
+		preds[id] = p
 	}
 	arg := make([]datalog.Term, arity)
 	for i, n := range literal.nodeList {
 		leaf := n.(*leafNode)
-		t, ok := e.Term[leaf.val]
+		key := leaf.String()
+		t, ok := e.Term[key]
+		if !ok {
+			t, ok = terms[key]
+		}
 		if !ok {
 			switch n.Type() {
 			case nodeIdentifier:
 				t = NewIdent(leaf.val)
 			case nodeString:
 				t = NewQuoted(leaf.val)
+			case nodeNumber:
+				v, _ := strconv.ParseInt(leaf.val, 10, 64)
+				t = NewNumber(v)
 			case nodeVariable:
 				t = NewVar(leaf.val)
 			default:
 				panic("not reached")
 			}
-			e.Term[leaf.val] = t
+			terms[key] = t
 		}
 		arg[i] = t
 	}
@@ -329,12 +746,20 @@ func (e *Engine) recoverLiteral(literal *literalNode) *datalog.Literal {
 }
 
 func (e *Engine) track(c *datalog.Clause, inc int) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
 	e.trackLiteral(c.Head, inc)
 	for _, l := range c.Body {
 		e.trackLiteral(l, inc)
 	}
 }
 
+func (e *Engine) untrack(removed []*datalog.Clause) {
+	for _, c := range removed {
+		e.track(c, -1)
+	}
+}
+
 func (e *Engine) trackLiteral(l *datalog.Literal, inc int) {
 	e.trackObject(l.Pred, inc)
 	for _, t := range l.Arg {
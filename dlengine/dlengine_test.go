@@ -16,12 +16,18 @@ package dlengine
 
 import (
 	"bufio"
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"sort"
+	"strings"
 	"testing"
 
+	"github.com/kevinawalsh/datalog"
 	"github.com/kevinawalsh/datalog/dlprim"
 )
 
@@ -69,6 +75,20 @@ func TestLexerFail(t *testing.T) {
 	if l.nextToken().typ != itemError {
 		t.Fatalf("unexpected token: %s", item)
 	}
+
+	// Numbers must fit in an int64.
+	for _, n := range []string{"99999999999999999999", "-9223372036854775809"} {
+		l = lex("test", "age(alice, "+n+").")
+		item = runLexer(t, l)
+		if item.typ != itemError || !strings.Contains(item.val, "out of range") {
+			t.Fatalf("unexpected token for %s: %s", n, item)
+		}
+	}
+	l = lex("test", "age(alice, -9223372036854775808).")
+	item = runLexer(t, l)
+	if item.typ != itemEOF {
+		t.Fatalf("unexpected token: %s", item)
+	}
 }
 
 func TestParser(t *testing.T) {
@@ -77,7 +97,15 @@ ancestor(alice, bob).
 ancestor(alice, "bob smith").
 true.
 false~
-ancestor(X, Y)?`
+ancestor(X, Y)?
+sibling(X, Y) :- parent(Z, X), parent(Z, Y), X != Y, Z = "alice".
+adult(P) :- age(P, A), A >= 18, A < 150, 0 <= A, -1 > -2.
+total(X, S) :- price(X, P), tax(X, T), S = P + T, D = S / 2, M = D mod 7, N = -3 * M, Z = N - 1.
+{ parent(alice, carol). ancestor(X, Y) :- parent(X, Y). } ancestor(alice, X)?
+{ } ancestor(alice, X)?
+ancestor(alice, X)~~
+.input parent(X, Y, "bio") "parent.csv"
+.output ancestor(alice, X) "out.tsv"`
 	node, err := parse("test",  input)
 	if err != nil {
 		t.Fatal(err.Error())
@@ -97,6 +125,103 @@ ancestor(X, Y)?`
 
 
 
+func TestParseError(t *testing.T) {
+	input := "ancestor(alice, bob).\n\tancestor(bob, carol) :- parent(bob,, carol)."
+	_, err := parse("test", input)
+	errs, ok := err.(ParseErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("expected ParseErrors, got %v", err)
+	}
+	perr := errs[0]
+	if perr.Name != "test" || perr.Line != 2 || perr.Col != 37 || perr.Offset != 58 {
+		t.Fatalf("unexpected position: %+v", perr)
+	}
+	expected := "datalog: test:2:37: expecting variable or constant, found: punct[\",\"]\n" +
+		"\t\tancestor(bob, carol) :- parent(bob,, carol).\n" +
+		"\t\t                                   ^"
+	if perr.Error() != expected {
+		t.Fatalf("unexpected error:\n%s\nexpected:\n%s", perr, expected)
+	}
+
+	// Lexer errors are reported where they occur.
+	_, err = parse("test", "a.\nb.\nc(\"x\") : d(X).")
+	errs, ok = err.(ParseErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if perr = errs[0]; perr.Line != 3 || perr.Col != 8 || perr.Msg != `expecting ":-"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Columns count runes, not bytes.
+	_, err = parse("test", `p("é", x`)
+	errs, ok = err.(ParseErrors)
+	if !ok || len(errs) != 1 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if perr = errs[0]; perr.Line != 1 || perr.Col != 9 {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestParseErrorRecovery(t *testing.T) {
+	input := `
+		a(x, y).
+		a(x y).
+		a(x, y) :- b(x), c(x)~~
+		{ b(x). c(x y). } a(x, Y)?
+		.inptu a(X) "a.csv"
+		.input a(X) b
+		.input a(X) "a.csv"
+		a(x, Y)?
+		a(?, y).
+		a(x, "y) : b.`
+	_, err := parse("test", input)
+	errs, ok := err.(ParseErrors)
+	if !ok {
+		t.Fatalf("expected ParseErrors, got %v", err)
+	}
+	lines := []int{3, 4, 5, 6, 7, 10, 11}
+	if len(errs) != len(lines) {
+		t.Fatalf("expected %d errors, got:\n%v", len(lines), err)
+	}
+	for i, perr := range errs {
+		if perr.Line != lines[i] {
+			t.Fatalf("expected error on line %d, got:\n%v", lines[i], perr)
+		}
+	}
+
+	// Nothing is executed if there are syntax errors.
+	e := NewEngine()
+	if _, _, err := e.Batch("test", input); err == nil {
+		t.Fatal("expected error")
+	}
+	if _, _, err := e.Batch("test", "a(x, y).\na(x y)."); err == nil || e.Pred["a/2"] != nil {
+		t.Fatalf("unexpected batch result: %v", err)
+	}
+	results := e.ProcessResults("test", input)
+	if len(results) != len(lines) || e.Pred["a/2"] != nil {
+		t.Fatalf("unexpected process results: %v", results)
+	}
+	for i, r := range results {
+		if r.Kind != StmtInvalid || r.Line != lines[i] {
+			t.Fatalf("unexpected result: %+v", r)
+		}
+	}
+
+	// Parentheses left open by a bad statement are forgotten at the next '.'
+	// or line, so later queries still end statements.
+	for input, line := range map[string]int{
+		"a(x y\nb(X)?\nc(x y).":     3,
+		"{ a(x y. } b(X)?\nc(x y).": 2,
+	} {
+		_, err := parse("test", input)
+		if errs, ok := err.(ParseErrors); !ok || len(errs) != 2 || errs[1].Line != line {
+			t.Fatalf("expected second error on line %d for %q, got:\n%v", line, input, err)
+		}
+	}
+}
+
 func setup(t *testing.T, input string, asserts, retracts, queries, errors int) *Engine {
 	e := NewEngine()
 	a, r, q, errs := e.Process("test", input)
@@ -134,29 +259,95 @@ func TestBatch(t *testing.T) {
 	}
 }
 
+func TestBatchQueries(t *testing.T) {
+	e := NewEngine()
+	results, err := e.BatchQueries("test", simpleProgram)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(results) != 5 {
+		t.Fatalf("expected results of 5 queries, got %d", len(results))
+	}
+	// The same query is answered differently as the database grows.
+	for i, n := range []int{1, 2, 3, 0, 0} {
+		r := results[i]
+		if r.Kind != StmtQuery || len(r.Answers) != n {
+			t.Fatalf("unexpected result %d: %v", i, r)
+		}
+	}
+	if r := results[4]; r.Text != "ancestor(alice, carol)?" || r.Line != 10 {
+		t.Fatalf("unexpected result: %s at line %d", r.Text, r.Line)
+	}
+
+	results, err = e.BatchQueries("test", `
+		ancestor(alice, X)?
+		ancestor(X, Y) :- unsafe(X).
+		ancestor(bob, X)?
+		`)
+	if err == nil || len(results) != 1 || len(results[0].Answers) != 1 {
+		t.Fatalf("expected error after first query, got %v, %v", results, err)
+	}
+}
+
+func TestLoad(t *testing.T) {
+	e := NewEngine()
+	added, known, err := e.Load("test", simpleProgram)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if added != 3 || known != 0 {
+		t.Fatalf("load failed: %d %d\n", added, known)
+	}
+	added, known, err = e.Load("test", simpleProgram)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if added != 1 || known != 2 {
+		t.Fatalf("reload failed: %d %d\n", added, known)
+	}
+	ok, err := e.Assert("ancestor(alice, \"bob smith\")")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if ok {
+		t.Fatal("duplicate assertion reported as new")
+	}
+	a, err := e.Query("ancestor(X, Y)")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(a) != 1 {
+		t.Fatalf("unexpected answers: %v", a)
+	}
+	added, known, err = e.Load("test", "ancestor(alice, X).")
+	if err == nil || added != 0 || known != 0 {
+		t.Fatalf("unsafe clause counted: %d %d %v\n", added, known, err)
+	}
+}
+
 func TestEngineErrors(t *testing.T) {
 	setup(t, "ancestor(?)", 0, 0, 0, 1)
 }
 
 func TestAssert(t *testing.T) {
 	e := NewEngine()
-	err := e.Assert("same(1, 1).")
+	_, err := e.Assert("same(1, 1).")
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	err = e.Assert("same(1, 1)")
+	_, err = e.Assert("same(1, 1)")
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	err = e.Assert("same(1, 1)?")
+	_, err = e.Assert("same(1, 1)?")
 	if err == nil {
 		t.Fatal("assert with query should be error")
 	}
-	err = e.Assert("same(1, 1)~")
+	_, err = e.Assert("same(1, 1)~")
 	if err == nil {
 		t.Fatal("assert with retraction should be error")
 	}
-	err = e.Assert("same(1, 1). same(2, 2).")
+	_, err = e.Assert("same(1, 1). same(2, 2).")
 	if err == nil {
 		t.Fatal("multiple stmts should fail")
 	}
@@ -164,23 +355,23 @@ func TestAssert(t *testing.T) {
 
 func TestRetract(t *testing.T) {
 	e := NewEngine()
-	err := e.Retract("same(1, 1)~")
+	_, err := e.Retract("same(1, 1)~")
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	err = e.Retract("same(1, 1)")
+	_, err = e.Retract("same(1, 1)")
 	if err != nil {
 		t.Fatal(err.Error())
 	}
-	err = e.Retract("same(1, 1)?")
+	_, err = e.Retract("same(1, 1)?")
 	if err == nil {
 		t.Fatal("retract with query should be error")
 	}
-	err = e.Retract("same(1, 1).")
+	_, err = e.Retract("same(1, 1).")
 	if err == nil {
 		t.Fatal("retract with assertion should be error")
 	}
-	err = e.Retract("same(1, 1)~ same(2, 2)~")
+	_, err = e.Retract("same(1, 1)~ same(2, 2)~")
 	if err == nil {
 		t.Fatal("multiple stmts should fail")
 	}
@@ -220,19 +411,19 @@ func TestAddPred(t *testing.T) {
 	if len(ans) != 1 {
 		t.Fatal("expecting answer for query =(1, 1) but got nothing")
 	}
-	err = e.Assert("equals(1, 2)")
+	_, err = e.Assert("equals(1, 2)")
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = e.Retract("same(1, 1)")
+	_, err = e.Retract("same(1, 1)")
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = e.Assert("=(1, 0)")
+	_, err = e.Assert("=(1, 0)")
 	if err == nil {
 		t.Fatal("datalog allowed client to assert 1 = 0.")
 	}
-	err = e.Retract("=(1, 1)")
+	_, err = e.Retract("=(1, 1)")
 	if err == nil {
 		t.Fatal("datalog allowed client to retract 1 = 1.")
 	}
@@ -242,6 +433,288 @@ func TestAddPred(t *testing.T) {
 	}
 }
 
+func TestTermKeys(t *testing.T) {
+	e := setup(t, `
+		p(foo).
+		p("foo").
+		`, 2, 0, 0, 0)
+	if _, ok := e.Term["foo"].(*Ident); !ok {
+		t.Fatalf("expected identifier for foo, got %v", e.Term["foo"])
+	}
+	if _, ok := e.Term[`"foo"`].(*Quoted); !ok {
+		t.Fatalf("expected quoted string for \"foo\", got %v", e.Term[`"foo"`])
+	}
+	ans, err := e.Query("p(X)?")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ans) != 2 {
+		t.Fatalf("expected 2 answers, got %d", len(ans))
+	}
+}
+
+func TestRetractCount(t *testing.T) {
+	e := setup(t, "p(a). p(b). p(X) :- q(X). p(a)~ p(a)~", 3, 2, 0, 0)
+	n, err := e.Retract("p(b)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 clause removed, got %d", n)
+	}
+	n, err = e.Retract("p(Y) :- q(Y)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 rule removed, got %d", n)
+	}
+	n, err = e.Retract("p(b)")
+	if err != nil || n != 0 {
+		t.Fatalf("expected nothing removed, got %d, %v", n, err)
+	}
+
+	e.StrictRetract = true
+	_, err = e.Retract("p(b)")
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	a, r, q, errs := e.Process("strict", "p(c). p(c)~ p(c)~")
+	if a != 1 || r != 2 || q != 0 || errs != 1 {
+		t.Fatalf("strict process failed: %d %d %d %d", a, r, q, errs)
+	}
+	_, _, err = e.Batch("strict", "p(d). p(d)~ p(d)~ p(e).")
+	if err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if ans, _ := e.Query("p(e)"); len(ans) != 0 {
+		t.Fatal("batch continued after strict retraction failed")
+	}
+}
+
+func TestRetractMatching(t *testing.T) {
+	e := setup(t, `
+		session(alice, s1).
+		session(bob, s2).
+		session(bob, s3).
+		session(X, Y) :- guest(X), token(Y).
+		session(bob, X)~~
+		`, 4, 1, 0, 0)
+	a, err := e.Query("session(X, Y)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.String() != "session(alice, s1)." {
+		t.Fatalf("unexpected answer: %v", a)
+	}
+	n, err := e.Retract("session(X, X)~~")
+	if err != nil || n != 0 {
+		t.Fatalf("expected nothing removed, got %d, %v", n, err)
+	}
+	n, err = e.Retract("session(X, Y)~~")
+	if err != nil || n != 1 {
+		t.Fatalf("expected 1 fact removed, got %d, %v", n, err)
+	}
+	setup(t, "session(X, Y) :- guest(X), token(Y)~~", 0, 0, 0, 1)
+
+	n, err = e.Clear("session/2")
+	if err != nil || n != 1 {
+		t.Fatalf("expected rule removed, got %d, %v", n, err)
+	}
+	n, err = e.Clear("nonexistent/3")
+	if err != nil || n != 0 {
+		t.Fatalf("expected nothing removed, got %d, %v", n, err)
+	}
+	e.AddPred(dlprim.Equals)
+	if _, err = e.Clear("=/2"); err == nil {
+		t.Fatal("datalog allowed client to clear a custom predicate")
+	}
+	if _, err = e.Retract("=(X, 1)~~"); err == nil {
+		t.Fatal("datalog allowed client to retract from a custom predicate")
+	}
+}
+
+func TestDump(t *testing.T) {
+	e := setup(t, `
+		ancestor(X, Z) :- ancestor(X, Y), ancestor(Y, Z).
+		ancestor(X, Y) :- parent(X, Y).
+		parent(bob, carol).
+		parent(alice, "bob").
+		parent(alice, bob).
+		"odd name"(x).
+		flag.
+		gone(x).
+		gone(x)~
+		`, 8, 1, 0, 0)
+	e.AddPred(dlprim.Equals)
+	var buf bytes.Buffer
+	if err := e.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := `% "odd name"/1
+"odd name"(x).
+% ancestor/2
+ancestor(X, Y) :- parent(X, Y).
+ancestor(X, Z) :- ancestor(X, Y), ancestor(Y, Z).
+% flag/0
+flag.
+% parent/2
+parent(alice, "bob").
+parent(alice, bob).
+parent(bob, carol).
+`
+	if buf.String() != expected {
+		t.Fatalf("unexpected dump:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	// Predicate names are quoted if necessary.
+	p := NewPred("not an identifier", 0)
+	e.AddPred(p)
+	if _, err := datalog.NewClause(datalog.NewLiteral(p)).Assert(); err != nil {
+		t.Fatal(err)
+	}
+	buf.Reset()
+	if err := e.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected = `% "not an identifier"/0
+"not an identifier".
+` + expected
+	if buf.String() != expected {
+		t.Fatalf("unexpected dump:\n%s\nexpected:\n%s", buf.String(), expected)
+	}
+
+	// Reloading the dump produces an identical database.
+	e2 := NewEngine()
+	if _, _, err := e2.Batch("dump", buf.String()); err != nil {
+		t.Fatal(err)
+	}
+	var buf2 bytes.Buffer
+	if err := e2.Dump(&buf2); err != nil {
+		t.Fatal(err)
+	}
+	if buf2.String() != buf.String() {
+		t.Fatalf("reloaded dump differs:\n%s\nversus:\n%s", buf2.String(), buf.String())
+	}
+}
+
+// refCounts returns the engine's reference counts, sorted and printed.
+func refCounts(e *Engine) string {
+	var counts []string
+	for obj, n := range e.refCount {
+		counts = append(counts, fmt.Sprintf("%v: %d\n", obj, n))
+	}
+	sort.Strings(counts)
+	return strings.Join(counts, "")
+}
+
+func TestSaveRestore(t *testing.T) {
+	e := setup(t, `
+		ancestor(X, Z) :- ancestor(X, Y), ancestor(Y, Z).
+		ancestor(X, Y) :- parent(X, Y).
+		parent(alice, "bob").
+		parent(alice, bob).
+		parent(bob, "Carol\n").
+		"odd name"(x).
+		flag.
+		same(X, Y) :- parent(X, Z), =(Z, Y).
+		`, 8, 0, 0, 0)
+	var saved bytes.Buffer
+	if err := e.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	data := saved.Bytes()
+
+	e2 := NewEngine()
+	e2.AddPred(dlprim.Equals)
+	if err := e2.Restore(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	var dump1, dump2 bytes.Buffer
+	e.Dump(&dump1)
+	e2.Dump(&dump2)
+	if dump1.String() != dump2.String() {
+		t.Fatalf("restored database differs:\n%s\nversus:\n%s", dump2.String(), dump1.String())
+	}
+	if r1, r2 := refCounts(e), refCounts(e2); r1 != r2 {
+		t.Fatalf("restored reference counts differ:\n%s\nversus:\n%s", r2, r1)
+	}
+	a, err := e2.Query(`ancestor(alice, "Carol\n")`)
+	if err != nil || len(a) != 1 {
+		t.Fatalf("unexpected answer: %v, %v", a, err)
+	}
+	a, err = e2.Query(`same(alice, X)`)
+	if err != nil || len(a) != 2 {
+		t.Fatalf("unexpected answer: %v, %v", a, err)
+	}
+
+	// Restoring into an engine that already has the data adds nothing.
+	if err := e2.Restore(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	dump2.Reset()
+	e2.Dump(&dump2)
+	if dump1.String() != dump2.String() {
+		t.Fatalf("restored database differs:\n%s\nversus:\n%s", dump2.String(), dump1.String())
+	}
+
+	// Corrupt, truncated, and incompatible snapshots are rejected cleanly.
+	for i := range data {
+		bad := append([]byte(nil), data...)
+		bad[i] ^= 0x20
+		e3 := NewEngine()
+		if err := e3.Restore(bytes.NewReader(bad)); err == nil {
+			t.Fatalf("corruption at byte %d not detected", i)
+		}
+		if len(e3.Pred) != len(NewEngine().Pred) || len(e3.Term) != 0 {
+			t.Fatalf("corrupt snapshot modified engine")
+		}
+	}
+	for n := 0; n < len(data); n++ {
+		if err := NewEngine().Restore(bytes.NewReader(data[:n])); err == nil {
+			t.Fatalf("truncation at byte %d not detected", n)
+		}
+	}
+	var newer bytes.Buffer
+	newer.WriteString(snapshotMagic)
+	newer.WriteByte(snapshotVersion + 1)
+	binary.Write(&newer, binary.BigEndian, crc32.ChecksumIEEE(newer.Bytes()))
+	if err := NewEngine().Restore(&newer); err == nil || err == ErrCorruptSnapshot {
+		t.Fatalf("expected version error, got %v", err)
+	}
+
+	// Version 1 snapshots, which had no numbers, are restored with identifiers
+	// like 7 as numbers.
+	var v1 bytes.Buffer
+	v1.WriteString(snapshotMagic)
+	v1.WriteByte(1)
+	v1.Write([]byte{2, snapIdent, 5, 'a', 'l', 'i', 'c', 'e', snapIdent, 1, '7'})
+	v1.Write([]byte{1, 3, 'a', 'g', 'e', 2})
+	v1.Write([]byte{1, 0, 0, 1, 0})
+	binary.Write(&v1, binary.BigEndian, crc32.ChecksumIEEE(v1.Bytes()))
+	e3 := NewEngine()
+	if err := e3.Restore(&v1); err != nil {
+		t.Fatal(err)
+	}
+	a, err = e3.Query("age(alice, X)")
+	if err != nil || len(a) != 1 {
+		t.Fatalf("unexpected answer: %v, %v", a, err)
+	}
+	if _, ok := a[0].Arg[1].(*Number); !ok {
+		t.Fatalf("expected number, got %T", a[0].Arg[1])
+	}
+
+	// Terms not created by an engine can't be saved.
+	p := NewPred("custom", 1)
+	e.AddPred(p)
+	if _, err := datalog.NewClause(datalog.NewLiteral(p, new(datalog.DistinctConst))).Assert(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Save(ioutil.Discard); err == nil {
+		t.Fatal("saved term that can't be restored")
+	}
+}
+
 // The remainder of this file is a simiple graph path-finding benchmark.
 
 type vertex []int
@@ -363,3 +836,196 @@ func BenchmarkDatalogPathFinding(b *testing.B) {
 	// go test completes in about 3.4 seconds on my system
 	// datalog's interp is about 13.5 seconds with same system, file, and query
 }
+
+func TestNumbers(t *testing.T) {
+	e := NewEngine()
+	if _, _, err := e.Batch("test", `
+		age(alice, 007). age(bob, 17). age(carol, -0). age(dave, "18"). age(eve, 18).
+		adult(P) :- age(P, A), A >= 18.
+		minor(P) :- age(P, A), A < 18.
+		`); err != nil {
+		t.Fatal(err)
+	}
+	a, err := e.Query("age(X, 7)")
+	if err != nil || len(a) != 1 || a[0].String() != "age(alice, 7)" {
+		t.Fatalf("unexpected answer: %v, %v", a, err)
+	}
+	if _, ok := a[0].Arg[1].(*Number); !ok {
+		t.Fatalf("expected number, got %T", a[0].Arg[1])
+	}
+	for query, n := range map[string]int{
+		"age(X, 0)": 1,
+		"adult(X)":  1,
+		"minor(X)":  3,
+		"7 = 007":   1,
+		"7 < 8":     1,
+		"7 > 8":     0,
+		"a < b":     0,
+		"-5 <= -5":  1,
+		`"1" < 2`:   0,
+		"X >= 1":    0,
+		">=(2, 1)":  1,
+	} {
+		a, err := e.Query(query)
+		if err != nil || len(a) != n {
+			t.Fatalf("%s: expected %d answers, got %v, %v", query, n, a, err)
+		}
+	}
+
+	// Numbers too large for an int64 are errors.
+	if _, err := e.Assert("age(frank, 9223372036854775808)"); err == nil {
+		t.Fatal("expected error for number out of range")
+	}
+
+	// Numbers survive CSV, JSON, and snapshots.
+	if _, _, err := e.ImportCSV(strings.NewReader("gina,021\nhal,x21\n"), "age(P, A)", nil); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := e.Query("age(P, 21)"); err != nil || len(a) != 1 {
+		t.Fatalf("unexpected answer: %v, %v", a, err)
+	}
+	j, err := e.QueryJSON("age(gina, X)")
+	if err != nil || j.Bindings[0]["X"] != (JSONTerm{JSONNumber, "21"}) {
+		t.Fatalf("unexpected answer: %v, %v", j, err)
+	}
+	var saved bytes.Buffer
+	if err := e.Save(&saved); err != nil {
+		t.Fatal(err)
+	}
+	e2 := NewEngine()
+	if err := e2.Restore(&saved); err != nil {
+		t.Fatal(err)
+	}
+	if d1, d2 := dump(t, e), dump(t, e2); d1 != d2 {
+		t.Fatalf("restored database differs:\n%s\nversus:\n%s", d2, d1)
+	}
+	if a, err := e2.Query("adult(X)"); err != nil || len(a) != 2 {
+		t.Fatalf("unexpected answer: %v, %v", a, err)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	e := NewEngine()
+	if _, err := e.Assert("ancestor(X, Y) :- parent(X, Y)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Assert("parent(alice, bob)"); err != nil {
+		t.Fatal(err)
+	}
+	s := e.Snapshot()
+
+	done := make(chan error)
+	go func() {
+		for i := 0; i < 100; i++ {
+			if _, err := e.Assert(fmt.Sprintf("parent(bob, c%d)", i)); err != nil {
+				done <- err
+				return
+			}
+		}
+		_, err := e.Retract("parent(alice, bob)")
+		done <- err
+	}()
+	for i := 0; i < 10; i++ {
+		a, err := s.Query("ancestor(X, Y)")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(a) != 1 || a.String() != "ancestor(alice, bob)." {
+			t.Fatalf("unexpected snapshot answer: %v", a)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := e.Query("ancestor(X, Y)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 100 {
+		t.Fatalf("expected 100 live answers, got %d", len(a))
+	}
+	a, err = s.Query("ancestor(bob, c7)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 0 {
+		t.Fatalf("unexpected snapshot answer: %v", a)
+	}
+}
+
+func TestQueryAssuming(t *testing.T) {
+	e := setup(t, `
+		access(X, secrets) :- role(X, admin).
+		role(bob, admin).
+		{ role(alice, admin). } access(alice, X)?
+		`, 2, 0, 1, 0)
+	a, err := e.Query("{ role(alice, admin). } access(alice, X)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.String() != "access(alice, secrets)." {
+		t.Fatalf("unexpected answer: %v", a)
+	}
+	a, err = e.Query("access(X, secrets)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.String() != "access(bob, secrets)." {
+		t.Fatalf("assumption was not discarded: %v", a)
+	}
+
+	// Names unknown to the engine are consistent within a snapshot query.
+	s := e.Snapshot()
+	a, err = s.Query("{ group(alice, ops). role(X, admin) :- group(X, ops). } access(alice, X)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 1 {
+		t.Fatalf("unexpected snapshot answer: %v", a)
+	}
+
+	_, err = e.Query("{ role(X, admin). } access(alice, X)")
+	if err == nil {
+		t.Fatal("unsafe assumption not detected")
+	}
+	setup(t, "{ role(X, admin). } access(alice, X)?", 0, 0, 1, 1)
+	setup(t, "{ role(alice, admin)~ } access(alice, X)?", 0, 0, 0, 1)
+}
+
+// benchmarkProgram returns n facts and a rule over them.
+func benchmarkProgram(n int) string {
+	var buf bytes.Buffer
+	buf.WriteString("path(X, Z) :- edge(X, Y), path(Y, Z).\n")
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&buf, "edge(v-%d, %d, \"w %d\").\n", i, i%100, i)
+	}
+	return buf.String()
+}
+
+func BenchmarkBatch(b *testing.B) {
+	input := benchmarkProgram(10000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := NewEngine().Batch("bench", input); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkRestore(b *testing.B) {
+	e := NewEngine()
+	if _, _, err := e.Batch("bench", benchmarkProgram(10000)); err != nil {
+		b.Fatal(err)
+	}
+	var saved bytes.Buffer
+	if err := e.Save(&saved); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := NewEngine().Restore(bytes.NewReader(saved.Bytes())); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlengine
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/kevinawalsh/datalog"
+)
+
+// Dump writes every fact and rule in the engine's database to w as datalog
+// assertions that can be loaded again with Batch or Process. Output is grouped
+// by predicate, with predicates ordered by name and arity and clauses ordered
+// by their text, so two engines holding the same database produce identical
+// output. Custom predicates like dlprim.Equals hold no clauses and are omitted.
+func (e *Engine) Dump(w io.Writer) error {
+	e.mu.RLock()
+	ids := make([]string, 0, len(e.Pred))
+	preds := make(map[string]datalog.Pred, len(e.Pred))
+	for _, p := range e.Pred {
+		id := predName(p) + "/" + strconv.Itoa(p.Arity())
+		ids = append(ids, id)
+		preds[id] = p
+	}
+	e.mu.RUnlock()
+	sort.Strings(ids)
+
+	out := bufio.NewWriter(w)
+	for _, id := range ids {
+		db, ok := preds[id].(interface {
+			Clauses() ([]*datalog.Clause, error)
+		})
+		if !ok {
+			continue
+		}
+		clauses, err := db.Clauses()
+		if err != nil {
+			return err
+		}
+		if len(clauses) == 0 {
+			continue
+		}
+		lines := make([]string, len(clauses))
+		for i, c := range clauses {
+			lines[i] = formatClause(c)
+		}
+		sort.Strings(lines)
+		fmt.Fprintf(out, "%% %s\n", id)
+		for _, line := range lines {
+			fmt.Fprintf(out, "%s.\n", line)
+		}
+	}
+	return out.Flush()
+}
+
+// formatClause returns the datalog syntax for c. Unlike c.String(), predicate
+// names are quoted where necessary so the result can be parsed again.
+func formatClause(c *datalog.Clause) string {
+	var buf bytes.Buffer
+	formatLiteral(&buf, c.Head)
+	for i, l := range c.Body {
+		if i == 0 {
+			buf.WriteString(" :- ")
+		} else {
+			buf.WriteString(", ")
+		}
+		formatLiteral(&buf, l)
+	}
+	return buf.String()
+}
+
+// predName returns the datalog syntax for the name of p.
+func predName(p datalog.Pred) string {
+	if p, ok := p.(*Pred); ok && !isPredSym(p.Name) {
+		return strconv.Quote(p.Name)
+	}
+	return fmt.Sprintf("%v", p)
+}
+
+// formatLiteral writes the datalog syntax for l into buf.
+func formatLiteral(buf *bytes.Buffer, l *datalog.Literal) {
+	buf.WriteString(predName(l.Pred))
+	if len(l.Arg) > 0 {
+		fmt.Fprintf(buf, "(%v", l.Arg[0])
+		for _, arg := range l.Arg[1:] {
+			fmt.Fprintf(buf, ", %v", arg)
+		}
+		buf.WriteString(")")
+	}
+}
+
+// isPredSym checks whether s would be lexed as a single identifier, string,
+// number, or operator, any of which can serve as a predicate symbol.
+func isPredSym(s string) bool {
+	l := lex("", s)
+	t := l.nextToken()
+	return (t.typ == itemIdentifier || t.typ == itemString || t.typ == itemNumber || t.infix()) &&
+		t.val == s && l.nextToken().typ == itemEOF
+}
@@ -0,0 +1,465 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlengine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kevinawalsh/datalog"
+)
+
+// SyncPolicy determines how often a Durable engine forces its log to disk.
+type SyncPolicy int
+
+const (
+	// SyncAlways forces the log to disk before any call that modifies the
+	// database returns. Nothing is lost in a crash.
+	SyncAlways SyncPolicy = iota
+
+	// SyncPeriodic forces the log to disk during a call that modifies the
+	// database if SyncInterval has elapsed since the last time. Changes made
+	// within the interval may be lost in a crash.
+	SyncPeriodic
+
+	// SyncNever leaves it to the operating system to write the log to disk,
+	// except during Compact, Sync, and Close. Any changes made since then may be
+	// lost in a crash.
+	SyncNever
+)
+
+// DurableOptions holds options for a Durable engine.
+type DurableOptions struct {
+	Sync         SyncPolicy
+	SyncInterval time.Duration // used only with SyncPeriodic
+
+	// CompactAfter, if positive, causes the log to be compacted automatically
+	// once it holds this many records.
+	CompactAfter int
+}
+
+// Durable wraps an Engine so that its database survives restarts. Every
+// assertion and retraction that changes the database is recorded in an
+// append-only log on disk. The log is periodically compacted into a binary
+// snapshot (see Engine.Save). When opened, the snapshot is restored and the log
+// is replayed. A partial record at the end of the log, e.g. left by a crash in
+// the middle of a write, is discarded.
+//
+// All changes must be made through the Durable, not through the underlying
+// Engine, or they will not be recorded.
+type Durable struct {
+	mu       sync.Mutex
+	engine   *Engine
+	dir      string
+	opts     DurableOptions
+	log      *os.File
+	records  int       // number of records in the log
+	lastSync time.Time // time the log was last forced to disk
+}
+
+// Files used by a Durable engine.
+const (
+	durableLog      = "log"
+	durableSnapshot = "snapshot"
+)
+
+// Log record operations.
+const (
+	opStatement byte = 's' // an assertion or retraction, in datalog syntax
+	opClear     byte = 'c' // a predicate to be cleared, as name/arity
+)
+
+// logHeaderSize is the size of the header on each log record: a big-endian
+// uint32 payload length, then a big-endian CRC-32 (IEEE) of the payload.
+const logHeaderSize = 8
+
+// OpenDurable opens or creates the durable database in directory dir, loading
+// its contents into e. Custom predicates, other than those added by NewEngine,
+// should be added to e beforehand. If opts is nil, default options are used.
+func OpenDurable(e *Engine, dir string, opts *DurableOptions) (*Durable, error) {
+	d := &Durable{engine: e, dir: dir}
+	if opts != nil {
+		d.opts = *opts
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if f, err := os.Open(filepath.Join(dir, durableSnapshot)); err == nil {
+		err = e.Restore(bufio.NewReader(f))
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	log, err := os.OpenFile(filepath.Join(dir, durableLog), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	end, err := d.replay(log)
+	if err == nil {
+		err = log.Truncate(end)
+	}
+	if err == nil {
+		_, err = log.Seek(end, io.SeekStart)
+	}
+	if err != nil {
+		log.Close()
+		return nil, err
+	}
+	d.log = log
+	d.lastSync = time.Now()
+	return d, nil
+}
+
+// replay applies each complete record in the log, returning the offset just
+// past the last one.
+func (d *Durable) replay(log *os.File) (int64, error) {
+	return readRecords(log, func(off int64, payload []byte) error {
+		if err := d.apply(payload[0], string(payload[1:])); err != nil {
+			return err
+		}
+		d.records++
+		return nil
+	})
+}
+
+// readRecords calls fn with the offset and payload of each complete record in
+// f, starting from the beginning, and returns the offset just past the last
+// one. A record that is truncated or fails its checksum, and everything after
+// it, is ignored.
+func readRecords(f *os.File, fn func(off int64, payload []byte) error) (int64, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	in := bufio.NewReader(f)
+	var end int64
+	header := make([]byte, logHeaderSize)
+	for {
+		if _, err := io.ReadFull(in, header); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return end, nil
+		} else if err != nil {
+			return 0, err
+		}
+		n := binary.BigEndian.Uint32(header[0:4])
+		if int64(n) > info.Size()-end-logHeaderSize {
+			return end, nil
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(in, payload); err == io.EOF || err == io.ErrUnexpectedEOF {
+			return end, nil
+		} else if err != nil {
+			return 0, err
+		}
+		if n == 0 || crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return end, nil
+		}
+		if err := fn(end, payload); err != nil {
+			return 0, err
+		}
+		end += int64(logHeaderSize + len(payload))
+	}
+}
+
+// apply performs the operation from a log record.
+func (d *Durable) apply(op byte, text string) error {
+	switch op {
+	case opStatement:
+		_, _, _, err := d.engine.batch(durableLog, text, false, nil)
+		return err
+	case opClear:
+		_, err := d.engine.Clear(text)
+		return err
+	default:
+		return errors.New("datalog: unknown operation in log")
+	}
+}
+
+// Engine returns the underlying engine, e.g. to add custom predicates or to
+// run queries. Changes must not be made directly to the engine.
+func (d *Durable) Engine() *Engine {
+	return d.engine
+}
+
+// Query parses the given string and executes the resulting query. See
+// Engine.Query.
+func (d *Durable) Query(query string) (datalog.Answers, error) {
+	return d.engine.Query(query)
+}
+
+// Assert is like Engine.Assert, but the assertion is recorded in the log if it
+// adds anything new to the database.
+func (d *Durable) Assert(assertion string) (bool, error) {
+	node, err := parseAssertion(assertion)
+	if err != nil {
+		return false, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	added, err := d.engine.assert(node.clause)
+	if err != nil || !added {
+		return added, err
+	}
+	if err := d.append(opStatement, node.String()); err != nil {
+		return true, err
+	}
+	return true, d.commit()
+}
+
+// Retract is like Engine.Retract, but the retraction is recorded in the log if
+// it removes anything from the database.
+func (d *Durable) Retract(retraction string) (int, error) {
+	node, err := parseRetraction(retraction)
+	if err != nil {
+		return 0, err
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, err := d.engine.retract(node.clause, node.action, d.engine.StrictRetract)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	if err := d.append(opStatement, node.String()); err != nil {
+		return n, err
+	}
+	return n, d.commit()
+}
+
+// Clear is like Engine.Clear, but the operation is recorded in the log if it
+// removes anything from the database.
+func (d *Durable) Clear(pred string) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	n, err := d.engine.Clear(pred)
+	if err != nil || n == 0 {
+		return n, err
+	}
+	if err := d.append(opClear, pred); err != nil {
+		return n, err
+	}
+	return n, d.commit()
+}
+
+// Batch is like Engine.Batch, but each assertion and retraction that changes
+// the database is recorded in the log, as is each new fact read by an .input
+// directive.
+func (d *Durable) Batch(name, input string) (assertions, retractions int, err error) {
+	pgm, err := parse(name, input)
+	if err != nil {
+		return
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	defer func() {
+		if cerr := d.commit(); err == nil {
+			err = cerr
+		}
+	}()
+	for _, node := range pgm.nodeList {
+		if node, ok := node.(*directiveNode); ok {
+			var n, known int
+			n, known, err = d.engine.directive(node, func(clause *clauseNode) error {
+				return d.append(opStatement, clause.String()+".")
+			})
+			if node.directive == "input" {
+				assertions += n + known
+			}
+			if err != nil {
+				return
+			}
+			continue
+		}
+		node, ok := node.(*actionNode)
+		if !ok {
+			continue
+		}
+		changed := false
+		if node.action == actionAssert {
+			changed, err = d.engine.assert(node.clause)
+			assertions++
+		} else {
+			var n int
+			n, err = d.engine.retract(node.clause, node.action, d.engine.StrictRetract)
+			changed = n > 0
+			retractions++
+		}
+		if err != nil {
+			return
+		}
+		if changed {
+			if err = d.append(opStatement, node.String()); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// append writes a record to the log. If this fails, the database may hold
+// changes that are not in the log, so the Durable should be closed and
+// reopened. Caller must hold d.mu.
+func (d *Durable) append(op byte, text string) error {
+	if d.log == nil {
+		return errors.New("datalog: durable engine is closed")
+	}
+	if _, err := d.log.Write(newRecord(op, []byte(text))); err != nil {
+		return err
+	}
+	d.records++
+	return nil
+}
+
+// newRecord returns a log record holding op followed by data.
+func newRecord(op byte, data []byte) []byte {
+	var buf bytes.Buffer
+	buf.Grow(logHeaderSize + 1 + len(data))
+	buf.Write(make([]byte, logHeaderSize))
+	buf.WriteByte(op)
+	buf.Write(data)
+	rec := buf.Bytes()
+	payload := rec[logHeaderSize:]
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(payload))
+	return rec
+}
+
+// commit forces the log to disk according to the sync policy, and compacts the
+// log if it has grown too long. Caller must hold d.mu.
+func (d *Durable) commit() error {
+	if d.log == nil {
+		return errors.New("datalog: durable engine is closed")
+	}
+	if d.opts.CompactAfter > 0 && d.records >= d.opts.CompactAfter {
+		return d.compact()
+	}
+	switch d.opts.Sync {
+	case SyncAlways:
+		return d.sync()
+	case SyncPeriodic:
+		if time.Since(d.lastSync) >= d.opts.SyncInterval {
+			return d.sync()
+		}
+	}
+	return nil
+}
+
+// Sync forces the log to disk.
+func (d *Durable) Sync() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.log == nil {
+		return errors.New("datalog: durable engine is closed")
+	}
+	return d.sync()
+}
+
+func (d *Durable) sync() error {
+	if err := d.log.Sync(); err != nil {
+		return err
+	}
+	d.lastSync = time.Now()
+	return nil
+}
+
+// Compact writes the entire database to a new snapshot, then empties the log.
+func (d *Durable) Compact() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.log == nil {
+		return errors.New("datalog: durable engine is closed")
+	}
+	return d.compact()
+}
+
+// compact replaces the snapshot, then truncates the log. If a crash happens
+// after the snapshot is replaced but before the log is truncated, the log will
+// be replayed over a snapshot that already reflects it. That is harmless: each
+// record leaves the clauses it touches in the same state no matter what state
+// they were in before. Caller must hold d.mu.
+func (d *Durable) compact() error {
+	tmp := filepath.Join(d.dir, durableSnapshot+".tmp")
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = d.engine.Save(f)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filepath.Join(d.dir, durableSnapshot))
+	}
+	if err == nil {
+		err = syncDir(d.dir)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := d.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := d.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	d.records = 0
+	return d.sync()
+}
+
+// syncDir forces a directory's entries to disk, so that a rename survives a
+// crash.
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	err = f.Sync()
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Close forces the log to disk and closes it. The underlying engine remains
+// usable, but further changes through the Durable are rejected.
+func (d *Durable) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.log == nil {
+		return errors.New("datalog: durable engine is closed")
+	}
+	err := d.log.Sync()
+	if cerr := d.log.Close(); err == nil {
+		err = cerr
+	}
+	d.log = nil
+	return err
+}
@@ -0,0 +1,214 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlengine
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func dump(t *testing.T, e *Engine) string {
+	var buf bytes.Buffer
+	if err := e.Dump(&buf); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+func openDurable(t *testing.T, dir string, opts *DurableOptions) *Durable {
+	d, err := OpenDurable(NewEngine(), dir, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+func TestDurable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := openDurable(t, dir, nil)
+	if _, _, err := d.Batch("test", `
+		ancestor(X, Z) :- ancestor(X, Y), ancestor(Y, Z).
+		parent(alice, bob).
+		parent(bob, carol).
+		parent(bob, dave).
+		ancestor(X, Y) :- parent(X, Y).
+		ancestor(X, Y)?
+		parent(bob, dave)~
+		`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Assert(`session(bob, "s1")`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Assert(`session(bob, "s2")`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Retract(`session(bob, X)~~`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Assert(`flag(x)`); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Clear(`flag/1`); err != nil {
+		t.Fatal(err)
+	}
+	expected := dump(t, d.Engine())
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Assert("parent(x, y)"); err == nil {
+		t.Fatal("closed durable engine accepted an assertion")
+	}
+
+	// Replay leaves StrictRetract alone, so it may be read concurrently.
+	e := NewEngine()
+	e.StrictRetract = true
+	done := make(chan bool)
+	go func() {
+		done <- e.StrictRetract
+	}()
+	d, err = OpenDurable(e, dir, nil)
+	if !<-done || err != nil {
+		t.Fatal(err)
+	}
+	if s := dump(t, d.Engine()); s != expected {
+		t.Fatalf("reopened database differs:\n%s\nversus:\n%s", s, expected)
+	}
+	a, err := d.Query("ancestor(alice, X)")
+	if err != nil || len(a) != 2 {
+		t.Fatalf("unexpected answer: %v, %v", a, err)
+	}
+
+	// Compaction moves everything into the snapshot.
+	if err := d.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if info, err := os.Stat(filepath.Join(dir, durableLog)); err != nil || info.Size() != 0 {
+		t.Fatalf("log not empty after compaction: %v, %v", info, err)
+	}
+	if _, err := d.Assert("parent(carol, eve)"); err != nil {
+		t.Fatal(err)
+	}
+	expected = dump(t, d.Engine())
+	d.Close()
+
+	d = openDurable(t, dir, nil)
+	if s := dump(t, d.Engine()); s != expected {
+		t.Fatalf("reopened database differs:\n%s\nversus:\n%s", s, expected)
+	}
+	d.Close()
+}
+
+func TestDurableCompactAfter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	d := openDurable(t, dir, &DurableOptions{Sync: SyncNever, CompactAfter: 3})
+	for _, s := range []string{"p(a)", "p(b)", "p(a)", "p(c)", "p(d)"} {
+		if _, err := d.Assert(s); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.records != 1 {
+		t.Fatalf("expected 1 record in log after compaction, got %d", d.records)
+	}
+	expected := dump(t, d.Engine())
+	d.Close()
+
+	d = openDurable(t, dir, nil)
+	if s := dump(t, d.Engine()); s != expected {
+		t.Fatalf("reopened database differs:\n%s\nversus:\n%s", s, expected)
+	}
+	d.Close()
+}
+
+func TestDurableRecovery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Record the expected database after each change, and the log size.
+	d := openDurable(t, dir, nil)
+	stmts := []string{"p(a).", "p(b).", `q("hello, world").`, "p(a)~", "p(X)~~", "r(z)."}
+	expected := []string{dump(t, d.Engine())}
+	sizes := []int64{0}
+	for _, s := range stmts {
+		if _, _, err := d.Batch("test", s); err != nil {
+			t.Fatal(err)
+		}
+		info, err := os.Stat(filepath.Join(dir, durableLog))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected = append(expected, dump(t, d.Engine()))
+		sizes = append(sizes, info.Size())
+	}
+	d.Close()
+	log, err := ioutil.ReadFile(filepath.Join(dir, durableLog))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Truncate the log at every possible point, as if a crash happened in the
+	// middle of a write. Only complete records should be recovered.
+	for n := int64(0); n <= int64(len(log)); n++ {
+		if err := ioutil.WriteFile(filepath.Join(dir, durableLog), log[:n], 0600); err != nil {
+			t.Fatal(err)
+		}
+		i := len(sizes) - 1
+		for sizes[i] > n {
+			i--
+		}
+		d := openDurable(t, dir, nil)
+		if s := dump(t, d.Engine()); s != expected[i] {
+			t.Fatalf("truncated at %d, recovered:\n%s\nexpected:\n%s", n, s, expected[i])
+		}
+		// The partial record is discarded, so new records can be appended.
+		if _, err := d.Assert("s(new)"); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+		d = openDurable(t, dir, nil)
+		if a, err := d.Query("s(new)"); err != nil || len(a) != 1 {
+			t.Fatalf("truncated at %d, record appended after recovery was lost", n)
+		}
+		d.Close()
+	}
+
+	// A corrupt record, and everything after it, is discarded.
+	bad := append([]byte(nil), log...)
+	bad[sizes[2]+logHeaderSize+1] ^= 0xff
+	if err := ioutil.WriteFile(filepath.Join(dir, durableLog), bad, 0600); err != nil {
+		t.Fatal(err)
+	}
+	d = openDurable(t, dir, nil)
+	if s := dump(t, d.Engine()); s != expected[2] {
+		t.Fatalf("recovered:\n%s\nexpected:\n%s", s, expected[2])
+	}
+	d.Close()
+}
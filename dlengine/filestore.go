@@ -0,0 +1,428 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlengine
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/kevinawalsh/datalog"
+)
+
+// FileStore is a datalog.Store that keeps the clauses for a predicate in a file
+// rather than in memory. Only an index is held in memory: the position in the
+// file of each clause, by variant tag and by the first argument of its head.
+// Clauses are read from the file and parsed as needed. When the first argument
+// of a query is bound, only clauses with that argument, or with a variable in
+// its place, are read.
+//
+// The file is an append-only log of insertions and deletions, in the same
+// record format used by Durable. Deleted clauses take up space until Compact is
+// called. Changes are left to the operating system to write to disk, except
+// during Sync, Compact, and Close. A partial record at the end of the file,
+// e.g. left by a crash in the middle of a write, is discarded when the store is
+// opened.
+//
+// A FileStore can only hold clauses made from Ident, Quoted, Number, and Var
+// terms and from predicates known to its engine, since clauses are read back
+// from the file using the engine. Clauses asserted through the engine qualify.
+type FileStore struct {
+	mu     sync.Mutex
+	engine *Engine
+	path   string
+	f      *os.File
+	end    int64                      // offset just past the last record
+	live   map[string]fileEntry       // live clauses, by variant tag
+	first  map[string]map[string]bool // tags of live clauses, by first argument
+	dead   int                        // records that are not for live clauses
+}
+
+// fileEntry locates a live clause in a FileStore.
+type fileEntry struct {
+	off   int64  // offset of the insertion record
+	first string // key for the first argument of the head, see firstKey
+}
+
+// FileStore record operations.
+const (
+	opInsert byte = '+' // a clause, in datalog syntax
+	opDelete byte = '-' // offset of an insertion record, as a uvarint
+)
+
+// ErrCorruptStore is returned by a FileStore if a record that was previously
+// written can't be read back.
+var ErrCorruptStore = errors.New("datalog: corrupt store")
+
+// AddFilePred adds a predicate with the given name and arity to the engine,
+// backed by a FileStore using the file at path, which is created if needed.
+// Clauses already in the file are available immediately. If the engine already
+// has a database-defined predicate with that name and arity, that predicate is
+// used, provided it holds no clauses.
+func (e *Engine) AddFilePred(name string, arity int, path string) (*FileStore, error) {
+	id := name + "/" + strconv.Itoa(arity)
+	e.mu.Lock()
+	p, ok := e.Pred[id]
+	if !ok {
+		p = NewPred(name, arity)
+		e.Pred[id] = p
+	}
+	e.mu.Unlock()
+	pred, ok := p.(*Pred)
+	if !ok {
+		return nil, fmt.Errorf("datalog: can't change store for custom predicate %s", id)
+	}
+	if db, err := pred.Clauses(); err != nil || len(db) > 0 {
+		return nil, fmt.Errorf("datalog: can't change store for non-empty predicate %s", id)
+	}
+	s, err := OpenFileStore(e, path)
+	if err != nil {
+		return nil, err
+	}
+	pred.SetStore(s)
+	return s, nil
+}
+
+// OpenFileStore opens or creates a FileStore using the file at path. Every
+// predicate that appears in the file, including the one that will use the
+// store, should be added to e beforehand. AddFilePred takes care of this.
+func OpenFileStore(e *Engine, path string) (*FileStore, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	s := &FileStore{engine: e, path: path, f: f}
+	if err := s.load(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(s.end); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load reads the file, building the index. Caller must hold s.mu or have
+// exclusive access to s.
+func (s *FileStore) load() error {
+	s.live = make(map[string]fileEntry)
+	s.first = make(map[string]map[string]bool)
+	s.dead = 0
+	tags := make(map[int64]string)
+	end, err := readRecords(s.f, func(off int64, payload []byte) error {
+		switch payload[0] {
+		case opInsert:
+			c, err := s.decode(payload)
+			if err != nil {
+				return err
+			}
+			tag := c.Tag()
+			if _, ok := s.live[tag]; ok {
+				return ErrCorruptStore
+			}
+			s.index(tag, fileEntry{off, firstKey(c)})
+			tags[off] = tag
+		case opDelete:
+			x, n := binary.Uvarint(payload[1:])
+			tag, ok := tags[int64(x)]
+			if n <= 0 || !ok {
+				return ErrCorruptStore
+			}
+			s.unindex(tag)
+			delete(tags, int64(x))
+			s.dead += 2
+		default:
+			return ErrCorruptStore
+		}
+		return nil
+	})
+	s.end = end
+	return err
+}
+
+// firstKey returns the key for the first argument of the head of c. Variables
+// have an empty key, which can't be confused with any constant.
+func firstKey(c *datalog.Clause) string {
+	if len(c.Head.Arg) == 0 || c.Head.Arg[0].Variable() {
+		return ""
+	}
+	return fmt.Sprintf("%v", c.Head.Arg[0])
+}
+
+// index adds a live clause to the index.
+func (s *FileStore) index(tag string, entry fileEntry) {
+	s.live[tag] = entry
+	tags, ok := s.first[entry.first]
+	if !ok {
+		tags = make(map[string]bool)
+		s.first[entry.first] = tags
+	}
+	tags[tag] = true
+}
+
+// unindex removes a live clause from the index.
+func (s *FileStore) unindex(tag string) {
+	entry := s.live[tag]
+	delete(s.live, tag)
+	delete(s.first[entry.first], tag)
+	if len(s.first[entry.first]) == 0 {
+		delete(s.first, entry.first)
+	}
+}
+
+// decode parses the clause in an insertion record, using objects from the
+// engine.
+func (s *FileStore) decode(payload []byte) (*datalog.Clause, error) {
+	node, err := parseAssertion(string(payload[1:]) + ".")
+	if err != nil {
+		return nil, ErrCorruptStore
+	}
+	return s.engine.recoverClause(node.clause), nil
+}
+
+// read reads and decodes the insertion record at offset off.
+func (s *FileStore) read(off int64) (*datalog.Clause, error) {
+	header := make([]byte, logHeaderSize)
+	if _, err := s.f.ReadAt(header, off); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint32(header[0:4])
+	if int64(n) > s.end-off-logHeaderSize || n == 0 {
+		return nil, ErrCorruptStore
+	}
+	payload := make([]byte, n)
+	if _, err := s.f.ReadAt(payload, off+logHeaderSize); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) || payload[0] != opInsert {
+		return nil, ErrCorruptStore
+	}
+	return s.decode(payload)
+}
+
+// write appends a record to the file, returning its offset.
+func (s *FileStore) write(op byte, data []byte) (int64, error) {
+	if s.f == nil {
+		return 0, errors.New("datalog: store is closed")
+	}
+	rec := newRecord(op, data)
+	off := s.end
+	if _, err := s.f.WriteAt(rec, off); err != nil {
+		return 0, err
+	}
+	s.end += int64(len(rec))
+	return off, nil
+}
+
+// check ensures that c would be read back from the file as the same objects.
+func (s *FileStore) check(c *datalog.Clause) error {
+	e := s.engine
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+	for _, l := range append([]*datalog.Literal{c.Head}, c.Body...) {
+		if e.Pred[fmt.Sprintf("%v", l.Pred)+"/"+strconv.Itoa(l.Pred.Arity())] != l.Pred {
+			return fmt.Errorf("datalog: can't store predicate %v not known to engine", l.Pred)
+		}
+		for _, t := range l.Arg {
+			switch t.(type) {
+			case *Ident, *Quoted, *Number, *Var:
+				if e.Term[fmt.Sprintf("%v", t)] == t {
+					continue
+				}
+			}
+			return fmt.Errorf("datalog: can't store term %v not known to engine", t)
+		}
+	}
+	return nil
+}
+
+// Insert appends c to the file, unless a clause with the same tag is present.
+func (s *FileStore) Insert(tag string, c *datalog.Clause) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.live[tag]; ok {
+		return false, nil
+	}
+	if err := s.check(c); err != nil {
+		return false, err
+	}
+	off, err := s.write(opInsert, []byte(formatClause(c)))
+	if err != nil {
+		return false, err
+	}
+	s.index(tag, fileEntry{off, firstKey(c)})
+	return true, nil
+}
+
+// Delete appends a deletion record for the clause with the given tag, if it is
+// present, and returns that clause as read from the file.
+func (s *FileStore) Delete(tag string) (*datalog.Clause, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entry, ok := s.live[tag]
+	if !ok {
+		return nil, nil
+	}
+	c, err := s.read(entry.off)
+	if err != nil {
+		return nil, err
+	}
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(entry.off))
+	if _, err := s.write(opDelete, buf[:n]); err != nil {
+		return nil, err
+	}
+	s.unindex(tag)
+	s.dead += 2
+	return c, nil
+}
+
+// Scan reads each clause that might match bound from the file, in the order
+// they were inserted, and calls fn for each one.
+func (s *FileStore) Scan(bound []datalog.Term, fn func(c *datalog.Clause)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return errors.New("datalog: store is closed")
+	}
+	var offs []int64
+	if len(bound) > 0 && bound[0] != nil {
+		for _, key := range []string{"", fmt.Sprintf("%v", bound[0])} {
+			for tag := range s.first[key] {
+				offs = append(offs, s.live[tag].off)
+			}
+		}
+	} else {
+		for _, entry := range s.live {
+			offs = append(offs, entry.off)
+		}
+	}
+	sort.Sort(offsets(offs))
+	for _, off := range offs {
+		c, err := s.read(off)
+		if err != nil {
+			return err
+		}
+		fn(c)
+	}
+	return nil
+}
+
+// offsets implements sort.Interface.
+type offsets []int64
+
+func (o offsets) Len() int           { return len(o) }
+func (o offsets) Less(i, j int) bool { return o[i] < o[j] }
+func (o offsets) Swap(i, j int)      { o[i], o[j] = o[j], o[i] }
+
+// Len returns the number of clauses in the store.
+func (s *FileStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.live)
+}
+
+// Garbage returns the number of records in the file that are no longer needed,
+// i.e. deletions and the insertions they cancel. Compact removes them.
+func (s *FileStore) Garbage() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.dead
+}
+
+// Sync forces the file to disk.
+func (s *FileStore) Sync() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return errors.New("datalog: store is closed")
+	}
+	return s.f.Sync()
+}
+
+// Compact rewrites the file so that it holds only the live clauses. The new
+// file is written alongside the old one, then renamed over it, so a crash at
+// any point leaves one or the other intact.
+func (s *FileStore) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return errors.New("datalog: store is closed")
+	}
+	offs := make([]int64, 0, len(s.live))
+	for _, entry := range s.live {
+		offs = append(offs, entry.off)
+	}
+	sort.Sort(offsets(offs))
+
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	var end int64
+	for _, off := range offs {
+		var c *datalog.Clause
+		c, err = s.read(off)
+		if err != nil {
+			break
+		}
+		rec := newRecord(opInsert, []byte(formatClause(c)))
+		if _, err = f.WriteAt(rec, end); err != nil {
+			break
+		}
+		end += int64(len(rec))
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err == nil {
+		err = syncDir(filepath.Dir(s.path))
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	s.f.Close()
+	s.f = f
+	return s.load()
+}
+
+// Close forces the file to disk and closes it. The predicate using the store
+// can no longer be used.
+func (s *FileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.f == nil {
+		return errors.New("datalog: store is closed")
+	}
+	err := s.f.Sync()
+	if cerr := s.f.Close(); err == nil {
+		err = cerr
+	}
+	s.f = nil
+	return err
+}
@@ -0,0 +1,139 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlengine
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/kevinawalsh/datalog"
+)
+
+const ancestorRules = `
+	ancestor(X, Y) :- parent(X, Y).
+	ancestor(X, Z) :- ancestor(X, Y), ancestor(Y, Z).
+	`
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "datalog")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "parent.db")
+
+	e := NewEngine()
+	s, err := e.AddFilePred("parent", 2, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := e.Batch("test", ancestorRules+`
+		parent(alice, bob).
+		parent(bob, "Carol").
+		parent(bob, dave).
+		parent(alice, bob).
+		parent(X, eve) :- ancestor(X, dave).
+		parent(bob, dave)~
+		parent(bob, dave).
+		`); err != nil {
+		t.Fatal(err)
+	}
+	if n := s.Len(); n != 4 {
+		t.Fatalf("expected 4 clauses in store, got %d", n)
+	}
+	if n := s.Garbage(); n != 2 {
+		t.Fatalf("expected 2 garbage records, got %d", n)
+	}
+	a, err := e.Query("ancestor(alice, X)")
+	if err != nil || len(a) != 4 {
+		t.Fatalf("unexpected answer: %v, %v", a, err)
+	}
+
+	// A bound first argument limits the clauses read from the file.
+	var scanned int
+	count := func(c *datalog.Clause) { scanned++ }
+	if err := s.Scan([]datalog.Term{e.Term["bob"], nil}, count); err != nil || scanned != 3 {
+		t.Fatalf("expected 3 clauses scanned, got %d, %v", scanned, err)
+	}
+
+	// Snapshots copy the clauses from the file.
+	snap := e.Snapshot()
+	if _, err := e.Retract(`parent(bob, X)~~`); err != nil {
+		t.Fatal(err)
+	}
+	if a, err := snap.Query(`parent(bob, X)`); err != nil || len(a) != 3 {
+		t.Fatalf("unexpected snapshot answer: %v, %v", a, err)
+	}
+	expected := dump(t, e)
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Query(`parent(X, Y)`); err == nil {
+		t.Fatal("expected error querying a closed store")
+	}
+
+	// Reopen in a new engine.
+	e = NewEngine()
+	s, err = e.AddFilePred("parent", 2, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Batch("test", ancestorRules)
+	if d := dump(t, e); d != expected {
+		t.Fatalf("reopened database differs:\n%s\nversus:\n%s", d, expected)
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if compacted, err := os.Stat(path); err != nil || compacted.Size() >= info.Size() || s.Garbage() != 0 {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	if d := dump(t, e); d != expected {
+		t.Fatalf("compacted database differs:\n%s\nversus:\n%s", d, expected)
+	}
+
+	// Writes after compaction go to the new file, and a torn write is ignored.
+	if _, err := e.Assert(`parent(carol, frank)`); err != nil {
+		t.Fatal(err)
+	}
+	expected = dump(t, e)
+	s.Close()
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write(newRecord(opInsert, []byte("parent(carol, gina)"))[:12])
+	f.Close()
+	e = NewEngine()
+	if _, err := e.AddFilePred("parent", 2, path); err != nil {
+		t.Fatal(err)
+	}
+	e.Batch("test", ancestorRules)
+	if d := dump(t, e); d != expected {
+		t.Fatalf("reopened database differs:\n%s\nversus:\n%s", d, expected)
+	}
+
+	// Only clauses made from the engine's own objects can be stored.
+	alien := datalog.NewClause(datalog.NewLiteral(e.Pred["parent/2"], NewIdent("x"), NewIdent("y")))
+	if _, err := alien.Assert(); err == nil {
+		t.Fatal("clause with unknown terms accepted")
+	}
+}
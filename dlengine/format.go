@@ -0,0 +1,245 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlengine
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/kevinawalsh/datalog"
+)
+
+// StmtKind identifies the kind of statement that produced a Result.
+type StmtKind int
+
+const (
+	StmtInvalid         StmtKind = iota // input that could not be parsed
+	StmtAssert                          // clause "."
+	StmtRetract                         // clause "~"
+	StmtRetractMatching                 // literal "~~"
+	StmtQuery                           // [ "{" (clause ".")* "}" ] literal "?"
+	StmtInput                           // ".input" literal string
+	StmtOutput                          // ".output" literal string
+)
+
+var stmtKindNames = []string{"invalid", "assert", "retract", "retract-matching", "query", "input", "output"}
+
+func (k StmtKind) String() string {
+	if k < 0 || int(k) >= len(stmtKindNames) {
+		return fmt.Sprintf("StmtKind(%d)", int(k))
+	}
+	return stmtKindNames[k]
+}
+
+// Result describes the outcome of executing one statement.
+type Result struct {
+	Kind   StmtKind
+	Source string // name of the input source
+	Pos    int    // byte offset of the statement in the input
+	Line   int    // line number of the statement, counting from 1
+	Col    int    // column number of the statement, counting from 1
+	Text   string // the statement, in datalog syntax
+
+	Clause  *datalog.Clause   // for assertions and retractions
+	Query   *datalog.Literal  // for queries
+	Assumed []*datalog.Clause // for queries with assumptions, otherwise nil
+	Answers datalog.Answers   // for queries
+
+	// Count is the number of clauses added by an assertion (0 or 1) or an
+	// .input directive, removed by a retraction, or written as rows by an
+	// .output directive.
+	Count int
+
+	// Known is the number of clauses that were already known, for an
+	// assertion (0 or 1) or an .input directive.
+	Known int
+
+	Err error
+}
+
+// Formatter writes a Result to w. Process uses a Formatter for its output.
+type Formatter interface {
+	Format(w io.Writer, r *Result) error
+}
+
+// TextFormatter writes each Result in a plain text format, echoing each
+// statement, then writing the answers to queries in datalog syntax, then either
+// "OK" or an error message. This is the default Formatter.
+type TextFormatter struct{}
+
+// Format writes r to w in plain text.
+func (TextFormatter) Format(w io.Writer, r *Result) error {
+	var buf bytes.Buffer
+	formatStatement(&buf, r)
+	if r.Kind == StmtQuery && r.Err == nil {
+		fmt.Fprintln(&buf, r.Answers)
+	}
+	formatOutcome(&buf, r)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// formatStatement writes the text that introduces r.
+func formatStatement(buf *bytes.Buffer, r *Result) {
+	switch r.Kind {
+	case StmtAssert:
+		fmt.Fprintf(buf, "Assert: %s\n", r.Clause)
+	case StmtRetract:
+		fmt.Fprintf(buf, "Retract: %s\n", r.Clause)
+	case StmtRetractMatching:
+		fmt.Fprintf(buf, "Retract matching: %s\n", r.Clause)
+	case StmtQuery:
+		if r.Assumed == nil {
+			fmt.Fprintf(buf, "Query: %s\n", r.Query)
+		} else {
+			fmt.Fprintf(buf, "Query: %s assuming %d clauses\n", r.Query, len(r.Assumed))
+		}
+	case StmtInput, StmtOutput:
+		fmt.Fprintf(buf, "%s\n", r.Text)
+	}
+}
+
+// formatOutcome writes "OK" or an error message for r.
+func formatOutcome(buf *bytes.Buffer, r *Result) {
+	if r.Err != nil {
+		if r.Kind == StmtInvalid {
+			fmt.Fprintf(buf, "%s\n", r.Err.Error())
+		} else {
+			fmt.Fprintf(buf, "datalog: %s:%d:%d: %s\n", r.Source, r.Line, r.Col, r.Err.Error())
+		}
+		return
+	}
+	switch r.Kind {
+	case StmtAssert:
+		if r.Known > 0 {
+			fmt.Fprintf(buf, "OK (already known)\n")
+		} else {
+			fmt.Fprintf(buf, "OK\n")
+		}
+	case StmtRetract, StmtRetractMatching:
+		fmt.Fprintf(buf, "OK (%d removed)\n", r.Count)
+	case StmtInput:
+		fmt.Fprintf(buf, "OK (%d added, %d already known)\n", r.Count, r.Known)
+	case StmtOutput:
+		fmt.Fprintf(buf, "OK (%d rows)\n", r.Count)
+	default:
+		fmt.Fprintf(buf, "OK\n")
+	}
+}
+
+// JSONFormatter writes each Result as a single line of JSON.
+type JSONFormatter struct{}
+
+// jsonResult is the JSON representation of a Result.
+type jsonResult struct {
+	Kind      string       `json:"kind"`
+	Source    string       `json:"source"`
+	Pos       int          `json:"pos"`
+	Line      int          `json:"line"`
+	Col       int          `json:"col"`
+	Statement string       `json:"statement,omitempty"`
+	Added     *int         `json:"added,omitempty"`
+	Known     *int         `json:"known,omitempty"`
+	Removed   *int         `json:"removed,omitempty"`
+	Rows      *int         `json:"rows,omitempty"`
+	Answers   *JSONAnswers `json:"answers,omitempty"`
+	Error     string       `json:"error,omitempty"`
+}
+
+// Format writes r to w as a line of JSON.
+func (JSONFormatter) Format(w io.Writer, r *Result) error {
+	j := jsonResult{Kind: r.Kind.String(), Source: r.Source, Pos: r.Pos, Line: r.Line, Col: r.Col, Statement: r.Text}
+	if r.Err != nil {
+		j.Error = r.Err.Error()
+	} else {
+		switch r.Kind {
+		case StmtAssert, StmtInput:
+			j.Added, j.Known = &r.Count, &r.Known
+		case StmtRetract, StmtRetractMatching:
+			j.Removed = &r.Count
+		case StmtOutput:
+			j.Rows = &r.Count
+		case StmtQuery:
+			j.Answers = NewJSONAnswers(r.Query, r.Answers)
+		}
+	}
+	data, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// TableFormatter writes the answers to each query as a table, with one column
+// for each of the query's variables and one row for each answer, sorted. Other
+// results are written as by TextFormatter.
+type TableFormatter struct{}
+
+// Format writes r to w, using a table for the answers to a query.
+func (TableFormatter) Format(w io.Writer, r *Result) error {
+	if r.Kind != StmtQuery || r.Err != nil {
+		return TextFormatter{}.Format(w, r)
+	}
+	var buf bytes.Buffer
+	formatStatement(&buf, r)
+	var header, dashes []string
+	var pos []int
+	seen := make(map[datalog.Term]bool)
+	for i, t := range r.Query.Arg {
+		if t.Variable() && !seen[t] {
+			seen[t] = true
+			name := fmt.Sprintf("%v", t)
+			header = append(header, name)
+			dashes = append(dashes, string(bytes.Repeat([]byte("-"), len(name))))
+			pos = append(pos, i)
+		}
+	}
+	rows := make([][]string, len(r.Answers))
+	for i, fact := range r.Answers {
+		rows[i] = make([]string, len(pos))
+		for k, p := range pos {
+			rows[i][k] = fmt.Sprintf("%v", fact.Arg[p])
+		}
+	}
+	sort.Sort(csvRows(rows))
+	if len(header) > 0 {
+		tw := tabwriter.NewWriter(&buf, 0, 8, 2, ' ', 0)
+		writeRow(tw, header)
+		writeRow(tw, dashes)
+		for _, row := range rows {
+			writeRow(tw, row)
+		}
+		tw.Flush()
+	}
+	if len(rows) == 1 {
+		fmt.Fprintf(&buf, "(1 row)\n")
+	} else {
+		fmt.Fprintf(&buf, "(%d rows)\n", len(rows))
+	}
+	formatOutcome(&buf, r)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// writeRow writes tab-separated cells to a tabwriter.
+func writeRow(w io.Writer, cells []string) {
+	fmt.Fprintf(w, "%s\n", strings.Join(cells, "\t"))
+}
@@ -0,0 +1,153 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlengine
+
+import (
+	"bytes"
+	"testing"
+)
+
+var formatProgram = `
+	parent(alice, bob).
+	parent(alice, "Carol").
+	parent(alice, bob).
+	parent(X, Y)~~
+	parent(alice, bob).
+	parent(alice, X)?
+	{ parent(bob, dave). } parent(X, dave)?
+	parent(X, Y) :- unsafe(X).
+	`
+
+func TestTextFormatter(t *testing.T) {
+	var out bytes.Buffer
+	e := NewEngine()
+	e.Out = &out
+	e.Process("test", formatProgram)
+	expected := `Assert: parent(alice, bob)
+OK
+Assert: parent(alice, "Carol")
+OK
+Assert: parent(alice, bob)
+OK (already known)
+Retract matching: parent(X, Y)
+OK (2 removed)
+Assert: parent(alice, bob)
+OK
+Query: parent(alice, X)
+parent(alice, bob).
+OK
+Query: parent(X, dave) assuming 1 clauses
+parent(bob, dave).
+OK
+Assert: parent(X, Y) :- unsafe(X)
+datalog: test:9:2: datalog: can't assert unsafe clause
+`
+	if s := out.String(); s != expected {
+		t.Fatalf("unexpected output:\n%s\nexpected:\n%s", s, expected)
+	}
+
+	out.Reset()
+	e.Process("test", "parent(alice")
+	if s := out.String(); s != "datalog: test:1:13: expecting ',' or ')', found: EOF\n\tparent(alice\n\t            ^\n" {
+		t.Fatalf("unexpected output: %q", s)
+	}
+}
+
+func TestJSONFormatter(t *testing.T) {
+	var out bytes.Buffer
+	e := NewEngine()
+	e.Out = &out
+	e.Formatter = JSONFormatter{}
+	e.Process("test", `
+		parent(alice, bob).
+		parent(alice, X)?
+		parent(X, Y)~
+		`)
+	expected := `{"kind":"assert","source":"test","pos":3,"line":2,"col":3,"statement":"parent(alice, bob).","added":1,"known":0}
+{"kind":"query","source":"test","pos":25,"line":3,"col":3,"statement":"parent(alice, X)?","answers":{"query":{"pred":"parent","args":[{"ident":"alice"},{"var":"X"}]},"facts":[{"pred":"parent","args":[{"ident":"alice"},{"ident":"bob"}]}],"bindings":[{"X":{"ident":"bob"}}]}}
+{"kind":"retract","source":"test","pos":45,"line":4,"col":3,"statement":"parent(X, Y)~","removed":0}
+`
+	if s := out.String(); s != expected {
+		t.Fatalf("unexpected output:\n%s\nexpected:\n%s", s, expected)
+	}
+}
+
+func TestTableFormatter(t *testing.T) {
+	var out bytes.Buffer
+	e := NewEngine()
+	e.Out = &out
+	e.Formatter = TableFormatter{}
+	e.Process("test", `
+		parent(alice, "Bob Smith").
+		parent(carol, dave).
+		parent(X, Y)?
+		parent(alice, dave)?
+		`)
+	expected := `Assert: parent(alice, "Bob Smith")
+OK
+Assert: parent(carol, dave)
+OK
+Query: parent(X, Y)
+X      Y
+-      -
+alice  "Bob Smith"
+carol  dave
+(2 rows)
+OK
+Query: parent(alice, dave)
+(0 rows)
+OK
+`
+	if s := out.String(); s != expected {
+		t.Fatalf("unexpected output:\n%s\nexpected:\n%s", s, expected)
+	}
+}
+
+func TestProcessResults(t *testing.T) {
+	e := NewEngine()
+	results := e.ProcessResults("test", formatProgram)
+	kinds := []StmtKind{StmtAssert, StmtAssert, StmtAssert, StmtRetractMatching, StmtAssert, StmtQuery, StmtQuery, StmtAssert}
+	if len(results) != len(kinds) {
+		t.Fatalf("expected %d results, got %d", len(kinds), len(results))
+	}
+	for i, r := range results {
+		if r.Kind != kinds[i] || r.Source != "test" {
+			t.Fatalf("result %d: expected %v, got %v from %q", i, kinds[i], r.Kind, r.Source)
+		}
+		if (r.Err != nil) != (i == 7) {
+			t.Fatalf("result %d: unexpected error: %v", i, r.Err)
+		}
+	}
+	if r := results[2]; r.Count != 0 || r.Known != 1 || r.Clause.String() != "parent(alice, bob)" {
+		t.Fatalf("unexpected assertion result: %+v", r)
+	}
+	if r := results[3]; r.Count != 2 {
+		t.Fatalf("expected 2 removed, got %d", r.Count)
+	}
+	if r := results[5]; r.Query.String() != "parent(alice, X)" || r.Assumed != nil || len(r.Answers) != 1 {
+		t.Fatalf("unexpected query result: %+v", r)
+	}
+	if r := results[6]; len(r.Assumed) != 1 || len(r.Answers) != 1 || r.Answers[0].String() != "parent(bob, dave)" {
+		t.Fatalf("unexpected query result: %+v", r)
+	}
+	if r := results[7]; r.Pos != 166 || r.Line != 9 || r.Col != 2 || r.Text != "parent(X, Y) :- unsafe(X)." {
+		t.Fatalf("unexpected error result: %+v", r)
+	}
+
+	results = e.ProcessResults("test", "parent(alice")
+	if len(results) != 1 || results[0].Kind != StmtInvalid || results[0].Err == nil {
+		t.Fatalf("expected a single invalid result, got %v", results)
+	}
+}
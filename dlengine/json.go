@@ -0,0 +1,271 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlengine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/kevinawalsh/datalog"
+)
+
+// JSON representation of terms, literals, and clauses. For example, the rule
+//   ancestor(X, "Bob") :- parent(X, bob)
+// is represented as:
+//   {"pred": "ancestor", "args": [{"var": "X"}, {"string": "Bob"}],
+//    "body": [{"pred": "parent", "args": [{"var": "X"}, {"ident": "bob"}]}]}
+
+// Kinds of JSONTerm.
+const (
+	JSONIdent  = "ident"
+	JSONString = "string"
+	JSONNumber = "number"
+	JSONVar    = "var"
+)
+
+// JSONTerm is the JSON representation of a term: an object with a single key,
+// the Kind, whose value is the Value of the term.
+type JSONTerm struct {
+	Kind  string // JSONIdent, JSONString, JSONNumber, or JSONVar
+	Value string // for JSONNumber, an integer in decimal
+}
+
+// MarshalJSON encodes t as an object with a single key.
+func (t JSONTerm) MarshalJSON() ([]byte, error) {
+	return json.Marshal(map[string]string{t.Kind: t.Value})
+}
+
+// UnmarshalJSON decodes an object with a single key.
+func (t *JSONTerm) UnmarshalJSON(data []byte) error {
+	var m map[string]string
+	if err := json.Unmarshal(data, &m); err != nil {
+		return err
+	}
+	if len(m) != 1 {
+		return fmt.Errorf("datalog: expecting term with one of ident, string, number, or var: %s", data)
+	}
+	for k, v := range m {
+		t.Kind, t.Value = k, v
+	}
+	return nil
+}
+
+// JSONLiteral is the JSON representation of a literal.
+type JSONLiteral struct {
+	Pred string     `json:"pred"`
+	Args []JSONTerm `json:"args,omitempty"`
+}
+
+// JSONClause is the JSON representation of a fact or rule.
+type JSONClause struct {
+	JSONLiteral
+	Body []JSONLiteral `json:"body,omitempty"`
+}
+
+// NewJSONTerm returns the JSON representation of t. Terms other than Ident,
+// Quoted, Number, and Var are represented as identifiers, using their %v
+// format.
+func NewJSONTerm(t datalog.Term) JSONTerm {
+	switch t := t.(type) {
+	case *Ident:
+		return JSONTerm{JSONIdent, t.Value}
+	case *Quoted:
+		return JSONTerm{JSONString, t.Value}
+	case *Number:
+		return JSONTerm{JSONNumber, t.String()}
+	case *Var:
+		return JSONTerm{JSONVar, t.Name}
+	default:
+		return JSONTerm{JSONIdent, fmt.Sprintf("%v", t)}
+	}
+}
+
+// NewJSONLiteral returns the JSON representation of l.
+func NewJSONLiteral(l *datalog.Literal) JSONLiteral {
+	name := fmt.Sprintf("%v", l.Pred)
+	if s, err := strconv.Unquote(name); err == nil {
+		name = s
+	}
+	j := JSONLiteral{Pred: name}
+	for _, t := range l.Arg {
+		j.Args = append(j.Args, NewJSONTerm(t))
+	}
+	return j
+}
+
+// NewJSONClause returns the JSON representation of c.
+func NewJSONClause(c *datalog.Clause) JSONClause {
+	j := JSONClause{JSONLiteral: NewJSONLiteral(c.Head)}
+	for _, l := range c.Body {
+		j.Body = append(j.Body, NewJSONLiteral(l))
+	}
+	return j
+}
+
+// node returns the parse tree for l.
+func (l *JSONLiteral) node() (*literalNode, error) {
+	predsym := l.Pred
+	if _, ok := isNumber(predsym); !ok && !isIdent(predsym) && !infixOps[predsym] {
+		predsym = strconv.Quote(predsym)
+	}
+	literal := newLiteral(pos{}, predsym)
+	for _, t := range l.Args {
+		var leaf *leafNode
+		switch t.Kind {
+		case JSONIdent:
+			if n, ok := isNumber(t.Value); ok {
+				leaf = newLeaf(nodeNumber, pos{}, n)
+				break
+			}
+			if !isIdent(t.Value) {
+				return nil, fmt.Errorf("datalog: invalid identifier: %q", t.Value)
+			}
+			leaf = newLeaf(nodeIdentifier, pos{}, t.Value)
+		case JSONString:
+			leaf = newLeaf(nodeString, pos{}, t.Value)
+		case JSONNumber:
+			n, ok := isNumber(t.Value)
+			if !ok {
+				return nil, fmt.Errorf("datalog: invalid number: %q", t.Value)
+			}
+			leaf = newLeaf(nodeNumber, pos{}, n)
+		case JSONVar:
+			if !isVariable(t.Value) {
+				return nil, fmt.Errorf("datalog: invalid variable: %q", t.Value)
+			}
+			leaf = newLeaf(nodeVariable, pos{}, t.Value)
+		default:
+			return nil, fmt.Errorf("datalog: unknown kind of term: %q", t.Kind)
+		}
+		literal.append(leaf)
+	}
+	return literal, nil
+}
+
+// node returns the parse tree for c.
+func (c *JSONClause) node() (*clauseNode, error) {
+	head, err := c.JSONLiteral.node()
+	if err != nil {
+		return nil, err
+	}
+	clause := newClause(pos{}, head)
+	for _, l := range c.Body {
+		body, err := l.node()
+		if err != nil {
+			return nil, err
+		}
+		clause.append(body)
+	}
+	return clause, nil
+}
+
+// isVariable checks whether s would be lexed as a single variable.
+func isVariable(s string) bool {
+	l := lex("", s)
+	t := l.nextToken()
+	return t.typ == itemVariable && t.val == s && l.nextToken().typ == itemEOF
+}
+
+// LoadJSON reads JSON lines from r, each holding a JSONClause, and adds each
+// fact or rule to the database. Blank lines are ignored. Like Load, it reports
+// how many clauses were new and how many were already known, and it stops at
+// the first error.
+func (e *Engine) LoadJSON(r io.Reader) (added, known int, err error) {
+	in := bufio.NewScanner(r)
+	in.Buffer(nil, 1<<30)
+	for line := 1; in.Scan(); line++ {
+		text := bytes.TrimSpace(in.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var c JSONClause
+		if err := json.Unmarshal(text, &c); err != nil {
+			return added, known, fmt.Errorf("datalog: line %d: %v", line, err)
+		}
+		clause, err := c.node()
+		if err != nil {
+			return added, known, fmt.Errorf("datalog: line %d: %v", line, err)
+		}
+		ok, err := e.assert(clause)
+		if err != nil {
+			return added, known, fmt.Errorf("datalog: line %d: %v", line, err)
+		}
+		if ok {
+			added++
+		} else {
+			known++
+		}
+	}
+	return added, known, in.Err()
+}
+
+// JSONAnswers is the JSON representation of the answers to a query, suitable
+// for API responses. For each answer, Facts holds the fact and Bindings holds
+// the values of the query's variables, by name.
+type JSONAnswers struct {
+	Query    JSONLiteral           `json:"query"`
+	Facts    []JSONLiteral         `json:"facts"`
+	Bindings []map[string]JSONTerm `json:"bindings"`
+}
+
+// NewJSONAnswers returns the JSON representation of the answers a to the given
+// query. Answers are sorted by their datalog syntax.
+func NewJSONAnswers(query *datalog.Literal, a datalog.Answers) *JSONAnswers {
+	sorted := make(datalog.Answers, len(a))
+	copy(sorted, a)
+	sort.Sort(byText(sorted))
+	j := &JSONAnswers{
+		Query:    NewJSONLiteral(query),
+		Facts:    make([]JSONLiteral, len(sorted)),
+		Bindings: make([]map[string]JSONTerm, len(sorted)),
+	}
+	for i, fact := range sorted {
+		j.Facts[i] = NewJSONLiteral(fact)
+		j.Bindings[i] = make(map[string]JSONTerm)
+		for k, t := range query.Arg {
+			if t.Variable() {
+				j.Bindings[i][fmt.Sprintf("%v", t)] = NewJSONTerm(fact.Arg[k])
+			}
+		}
+	}
+	return j
+}
+
+// byText implements sort.Interface.
+type byText datalog.Answers
+
+func (a byText) Len() int           { return len(a) }
+func (a byText) Less(i, j int) bool { return a[i].String() < a[j].String() }
+func (a byText) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+
+// QueryJSON parses the given string and executes the resulting query, like
+// Query, but returns the answers in their JSON representation.
+func (e *Engine) QueryJSON(query string) (*JSONAnswers, error) {
+	node, err := parseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	l, assumed := e.recoverQuery(node, true)
+	a, err := l.QueryAssuming(assumed...)
+	if err != nil {
+		return nil, err
+	}
+	return NewJSONAnswers(l, a), nil
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlengine
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestLoadJSON(t *testing.T) {
+	e := NewEngine()
+	input := `
+{"pred": "parent", "args": [{"ident": "alice"}, {"string": "Bob"}]}
+
+{"pred": "parent", "args": [{"string": "Bob"}, {"ident": "carol"}]}
+{"pred": "ancestor", "args": [{"var": "X"}, {"var": "Y"}], "body": [{"pred": "parent", "args": [{"var": "X"}, {"var": "Y"}]}]}
+{"pred": "ancestor", "args": [{"var": "X"}, {"var": "Z"}], "body": [{"pred": "ancestor", "args": [{"var": "X"}, {"var": "Y"}]}, {"pred": "ancestor", "args": [{"var": "Y"}, {"var": "Z"}]}]}
+{"pred": "odd name", "args": [{"ident": "x"}]}
+{"pred": "flag"}
+{"pred": "parent", "args": [{"ident": "alice"}, {"string": "Bob"}]}
+`
+	added, known, err := e.LoadJSON(strings.NewReader(input))
+	if err != nil || added != 6 || known != 1 {
+		t.Fatalf("unexpected load: %d, %d, %v", added, known, err)
+	}
+	for _, q := range []string{`ancestor(alice, carol)`, `"odd name"(x)`, `flag`} {
+		if a, err := e.Query(q); err != nil || len(a) != 1 {
+			t.Fatalf("unexpected answer for %s: %v, %v", q, a, err)
+		}
+	}
+
+	// Clauses convert back to the same JSON.
+	lines := strings.Split(strings.TrimSpace(input), "\n")
+	var c JSONClause
+	if err := json.Unmarshal([]byte(lines[3]), &c); err != nil {
+		t.Fatal(err)
+	}
+	node, _ := c.node()
+	data, err := json.Marshal(NewJSONClause(e.recoverClause(node)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := strings.Replace(lines[3], " ", "", -1); string(data) != s {
+		t.Fatalf("unexpected json:\n%s\nversus:\n%s", data, s)
+	}
+
+	for _, bad := range []string{
+		`{"pred": "p", "args": [{"ident": "Alice"}]}`,
+		`{"pred": "p", "args": [{"var": "x"}]}`,
+		`{"pred": "p", "args": [{"float": "1"}]}`,
+		`{"pred": "p", "args": [{"number": "one"}]}`,
+		`{"pred": "p", "args": [{"ident": "a", "string": "a"}]}`,
+		`{"pred": "p", "args": [{"var": "X"}]}`,
+		`{"pred": "p", "args": [`,
+	} {
+		if _, _, err := e.LoadJSON(strings.NewReader(bad)); err == nil {
+			t.Fatalf("bad input not detected: %s", bad)
+		}
+	}
+}
+
+func TestQueryJSON(t *testing.T) {
+	e := NewEngine()
+	e.Batch("test", `
+		parent(alice, "Bob").
+		parent(alice, carol).
+		parent(bob, dave).
+		`)
+	a, err := e.QueryJSON("parent(alice, X)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"query":{"pred":"parent","args":[{"ident":"alice"},{"var":"X"}]},` +
+		`"facts":[{"pred":"parent","args":[{"ident":"alice"},{"string":"Bob"}]},` +
+		`{"pred":"parent","args":[{"ident":"alice"},{"ident":"carol"}]}],` +
+		`"bindings":[{"X":{"string":"Bob"}},{"X":{"ident":"carol"}}]}`
+	if string(data) != expected {
+		t.Fatalf("unexpected json:\n%s\nversus:\n%s", data, expected)
+	}
+
+	a, err = e.QueryJSON("parent(carol, X)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := json.Marshal(a); !strings.Contains(string(data), `"facts":[],"bindings":[]`) {
+		t.Fatalf("unexpected json for no answers: %s", data)
+	}
+}
@@ -20,6 +20,7 @@ package dlengine
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"unicode"
 	"unicode/utf8"
@@ -29,6 +30,7 @@ import (
 type token struct {
 	typ itemType // Type, such as itemNumber.
 	val string   // Value, such as "23.2".
+	pos pos      // Position of the start of the token, or of an error.
 }
 
 // itemType identifies the type of lex items.
@@ -36,24 +38,38 @@ type itemType int
 
 // Comments: '%' to end of line (but not in strings), ignored
 // Whitespace: ignored, except in strings
-// Punctuation: '(’, ',’, ')’, ':-’, '.’, '~’, '?’, and '"’
-// Note: We don't treat '=' specially or as punctuation, and we don't handle
-// infix operators.
+// Punctuation: '(’, ',’, ')’, ':-’, '.’, '~’, '~~’, '?’, '{’, '}’, '"’, '=’, '!=’,
+// '<’, '<=’, '>’, and '>='
+// Note: '=', '!=', '<', '<=', '>', and '>=' are infix operators, but they can
+// also be used as predicate symbols, as in =(X, Y).
+// Arithmetic operators '+', '-', '*', '/', and 'mod' are lexed as identifiers,
+// so they must be separated from their operands by spaces, as in Z = X + Y.
+// Numbers: identifiers that are decimal integers, like 7, 007, and -42. It is
+// an error if a number is outside the range of an int64.
 
 const (
 	itemError itemType = iota // error occurred; value is text of error
 	itemEOF
-	itemQuestion // "?"
-	itemWhen     // ":-"
-	itemLP       // "("
-	itemRP       // ")"
-	itemComma    // ","
-	// itemEqual   // "="  // TODO(kwalsh) support infix equality?
-	itemDot        // "."
-	itemTilde      // "~"
-	itemVariable   // X, Alice, Hunter_22
-	itemIdentifier // alice, 7, -42, x
-	itemString     // "Alice"
+	itemQuestion     // "?"
+	itemWhen         // ":-"
+	itemLP           // "("
+	itemRP           // ")"
+	itemComma        // ","
+	itemEqual        // "="
+	itemNotEqual     // "!="
+	itemLess         // "<"
+	itemLessEqual    // "<="
+	itemGreater      // ">"
+	itemGreaterEqual // ">="
+	itemDot          // "."
+	itemTilde        // "~"
+	itemTildeTilde   // "~~"
+	itemLBrace       // "{"
+	itemRBrace       // "}"
+	itemVariable     // X, Alice, Hunter_22
+	itemIdentifier   // alice, x, -
+	itemNumber       // 7, -42
+	itemString       // "Alice"
 )
 
 func (i token) String() string {
@@ -66,6 +82,8 @@ func (i token) String() string {
 		return fmt.Sprintf("var[%q]", i.val)
 	case itemIdentifier:
 		return fmt.Sprintf("ident[%q]", i.val)
+	case itemNumber:
+		return fmt.Sprintf("num[%q]", i.val)
 	case itemString:
 		return fmt.Sprintf("str[%q]", i.val)
 	default:
@@ -73,6 +91,15 @@ func (i token) String() string {
 	}
 }
 
+// infix checks whether t is an infix operator, like "=" or "<".
+func (t token) infix() bool {
+	switch t.typ {
+	case itemEqual, itemNotEqual, itemLess, itemLessEqual, itemGreater, itemGreaterEqual:
+		return true
+	}
+	return false
+}
+
 // stateFn represents a state transition for the scanner.
 type stateFn func(*lexer) stateFn
 
@@ -86,12 +113,20 @@ type lexer struct {
 	state stateFn    // current state.
 	items chan token // channel of scanned items.
 	last  token      // last token returned by nextToken().
+	line  int        // line number of start.
+	sol   int        // start position of the line containing start.
 }
 
 // emit passes an token back to the client.
 func (l *lexer) emit(t itemType) {
-	l.items <- token{t, l.input[l.start:l.pos]}
-	l.start = l.pos
+	l.items <- token{t, l.input[l.start:l.pos], l.position()}
+	l.ignore()
+}
+
+// position returns the position of the start of this token.
+func (l *lexer) position() pos {
+	col := utf8.RuneCountInString(l.input[l.sol:l.start]) + 1
+	return pos{l.start, l.line, col}
 }
 
 const eof rune = 0
@@ -112,7 +147,12 @@ func lexMain(l *lexer) stateFn {
 			l.emit(itemDot)
 			return lexMain
 		case r == '~':
-			l.emit(itemTilde)
+			if strings.HasPrefix(l.input[l.pos:], "~") {
+				l.pos++
+				l.emit(itemTildeTilde)
+			} else {
+				l.emit(itemTilde)
+			}
 			return lexMain
 		case r == '(':
 			l.emit(itemLP)
@@ -120,6 +160,12 @@ func lexMain(l *lexer) stateFn {
 		case r == ')':
 			l.emit(itemRP)
 			return lexMain
+		case r == '{':
+			l.emit(itemLBrace)
+			return lexMain
+		case r == '}':
+			l.emit(itemRBrace)
+			return lexMain
 		case r == '?':
 			l.emit(itemQuestion)
 			return lexMain
@@ -134,6 +180,29 @@ func lexMain(l *lexer) stateFn {
 		case r == ',':
 			l.emit(itemComma)
 			return lexMain
+		case r == '=':
+			l.emit(itemEqual)
+			return lexMain
+		case r == '!' && strings.HasPrefix(l.input[l.pos:], "="):
+			l.pos++
+			l.emit(itemNotEqual)
+			return lexMain
+		case r == '<':
+			if strings.HasPrefix(l.input[l.pos:], "=") {
+				l.pos++
+				l.emit(itemLessEqual)
+			} else {
+				l.emit(itemLess)
+			}
+			return lexMain
+		case r == '>':
+			if strings.HasPrefix(l.input[l.pos:], "=") {
+				l.pos++
+				l.emit(itemGreaterEqual)
+			} else {
+				l.emit(itemGreater)
+			}
+			return lexMain
 		case r == '"':
 			l.backup()
 			return lexString
@@ -190,12 +259,22 @@ func lexVariable(l *lexer) stateFn {
 
 func lexIdentifier(l *lexer) stateFn {
 	// precondition: l.next() is printable, not banned punctuation, not [A-Z]
-	invalid := `?:()~".,%` // '='
+	invalid := `?:(){}~".,%=<>`
 	for {
 		r := l.next()
+		if r == '!' && strings.HasPrefix(l.input[l.pos:], "=") {
+			r = '='
+		}
 		if r == eof || unicode.IsSpace(r) || strings.IndexRune(invalid, r) >= 0 || !unicode.IsPrint(r) {
 			l.backup()
-			l.emit(itemIdentifier)
+			text := l.input[l.start:l.pos]
+			if _, err := strconv.ParseInt(text, 10, 64); err == nil {
+				l.emit(itemNumber)
+			} else if err.(*strconv.NumError).Err == strconv.ErrRange {
+				return l.errorf("number out of range: %s", text)
+			} else {
+				l.emit(itemIdentifier)
+			}
 			return lexMain
 		}
 	}
@@ -229,6 +308,12 @@ func (l *lexer) next() (r rune) {
 
 // ignore skips over the pending input before this point.
 func (l *lexer) ignore() {
+	for i := l.start; i < l.pos; i++ {
+		if l.input[i] == '\n' {
+			l.line++
+			l.sol = i + 1
+		}
+	}
 	l.start = l.pos
 }
 
@@ -244,6 +329,7 @@ func (l *lexer) errorf(format string, args ...interface{}) stateFn {
 	l.items <- token{
 		itemError,
 		fmt.Sprintf(format, args...),
+		l.position(),
 	}
 	return nil
 }
@@ -255,7 +341,8 @@ func lex(name, input string) *lexer {
 		input: input,
 		state: lexMain,
 		items: make(chan token, 2), // Two items is sufficient.
-		last: token{itemEOF, ""},
+		last:  token{itemEOF, "", pos{0, 1, 1}},
+		line:  1,
 	}
 }
 
@@ -31,9 +31,13 @@ type node interface {
 	Position() pos
 }
 
-// pos represents a byte position in the original input text from which
-// this template was parsed.
-type pos int
+// pos represents a position in the original input text from which a node was
+// parsed.
+type pos struct {
+	offset int // byte offset, counting from 0
+	line   int // line number, counting from 1
+	col    int // column number, in runes, counting from 1
+}
 
 func (p pos) Position() pos {
 	return p
@@ -47,18 +51,20 @@ func (t nodeType) Type() nodeType {
 }
 
 const (
-	nodeProgram nodeType = iota // program ::= (assertion | retraction | query)*
-	nodeAction                  // action ::= clause [ "." | "~" ]
-	nodeQuery                   // query ::= literal "?"
-	nodeClause                  // clause ::= literal | literal ":-" literal ("," literal)*
-	nodeLiteral                 // literal ::= predsym | predsym "(" term ("," term)* ")"
+	nodeProgram   nodeType = iota // program ::= (assertion | retraction | query | directive)*
+	nodeAction                    // action ::= clause [ "." | "~" ] | literal "~~"
+	nodeQuery                     // query ::= [ "{" (clause ".")* "}" ] literal "?"
+	nodeDirective                 // directive ::= "." [ "input" | "output" ] literal string
+	nodeClause                    // clause ::= literal | literal ":-" literal ("," literal)*
+	nodeLiteral                   // literal ::= predsym | predsym "(" term ("," term)* ")" | term operator term | term "=" term arithop term
 	// These next few are left blank since they are not present in the parse tree:
-	_              // nodePredSym ::= identifier | string
+	_              // nodePredSym ::= identifier | string | number | operator
 	_              // nodeTerm ::= variable | constant
-	_              // nodeConstant ::= identifier | string
+	_              // nodeConstant ::= identifier | string | number
 	nodeIdentifier // see lexer for syntax
 	nodeString     // see lexer for syntax
 	nodeVariable   // see lexer for syntax
+	nodeNumber     // see lexer for syntax
 )
 
 // nodeList stores a list of nodes in the order they were lexed.
@@ -117,10 +123,13 @@ type actionNode struct {
 	action actionType
 }
 
-type actionType bool
+type actionType int
 
-const actionAssert actionType = true
-const actionRetract actionType = false
+const (
+	actionAssert          actionType = iota // clause "."
+	actionRetract                           // clause "~"
+	actionRetractMatching                   // literal "~~"
+)
 
 func newAction(pos pos, clause *clauseNode, action actionType) *actionNode {
 	return &actionNode{nodeAction, pos, clause, action}
@@ -128,10 +137,13 @@ func newAction(pos pos, clause *clauseNode, action actionType) *actionNode {
 
 func (n *actionNode) String() string {
 	var suffix string
-	if n.action == actionAssert {
+	switch n.action {
+	case actionAssert:
 		suffix = "."
-	} else {
+	case actionRetract:
 		suffix = "~"
+	case actionRetractMatching:
+		suffix = "~~"
 	}
 	return n.clause.String() + suffix
 }
@@ -140,23 +152,52 @@ func (n *actionNode) Copy() node {
 	return &actionNode{nodeAction, n.pos, n.clause.Copy().(*clauseNode), n.action}
 }
 
-// queryNode holds a literal.
+// queryNode holds a literal and a sequence of assumed clauses.
 type queryNode struct {
 	nodeType
 	pos
 	literal *literalNode
+	assumed nodeList
 }
 
-func newQuery(pos pos, literal *literalNode) *queryNode {
-	return &queryNode{nodeQuery, pos, literal}
+func newQuery(pos pos, literal *literalNode, assumed nodeList) *queryNode {
+	return &queryNode{nodeQuery, pos, literal, assumed}
 }
 
 func (n *queryNode) String() string {
-	return n.literal.String() + "?"
+	if n.assumed == nil {
+		return n.literal.String() + "?"
+	}
+	if len(n.assumed) == 0 {
+		return "{ } " + n.literal.String() + "?"
+	}
+	return "{ " + n.assumed.join(". ") + ". } " + n.literal.String() + "?"
 }
 
 func (n *queryNode) Copy() node {
-	return &queryNode{nodeQuery, n.pos, n.literal.Copy().(*literalNode)}
+	return &queryNode{nodeQuery, n.pos, n.literal.Copy().(*literalNode), n.assumed.dup()}
+}
+
+// directiveNode holds a directive to read facts from a file into the database,
+// or to write answers to a query into a file.
+type directiveNode struct {
+	nodeType
+	pos
+	directive string // "input" or "output"
+	literal   *literalNode
+	file      string
+}
+
+func newDirective(pos pos, directive string, literal *literalNode, file string) *directiveNode {
+	return &directiveNode{nodeDirective, pos, directive, literal, file}
+}
+
+func (n *directiveNode) String() string {
+	return "." + n.directive + " " + n.literal.String() + " " + strconv.Quote(n.file)
+}
+
+func (n *directiveNode) Copy() node {
+	return &directiveNode{nodeDirective, n.pos, n.directive, n.literal.Copy().(*literalNode), n.file}
 }
 
 // clauseNode holds a head literal and a sequence of body literals.
@@ -195,12 +236,35 @@ func newLiteral(pos pos, predsym string) *literalNode {
 }
 
 func (n *literalNode) String() string {
+	if n.infix() {
+		return n.nodeList[0].String() + " " + n.predsym + " " + n.nodeList[1].String()
+	}
+	if n.arith() {
+		return n.nodeList[2].String() + " = " + n.nodeList[0].String() + " " + n.predsym + " " + n.nodeList[1].String()
+	}
 	if len(n.nodeList) == 0 {
 		return n.predsym
 	}
 	return n.predsym + "(" + n.join(", ") + ")"
 }
 
+// infix checks whether n is written with an infix operator, like X = Y.
+func (n *literalNode) infix() bool {
+	return len(n.nodeList) == 2 && infixOps[n.predsym]
+}
+
+// infixOps holds the predicate symbols that are written as infix operators.
+var infixOps = map[string]bool{"=": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+// arith checks whether n is written as arithmetic, like Z = X + Y.
+func (n *literalNode) arith() bool {
+	return len(n.nodeList) == 3 && arithOps[n.predsym]
+}
+
+// arithOps holds the predicate symbols that are written as arithmetic
+// operators, which must be separated from their operands by spaces.
+var arithOps = map[string]bool{"+": true, "-": true, "*": true, "/": true, "mod": true}
+
 func (n *literalNode) Copy() node {
 	return &literalNode{nodeLiteral, n.pos, n.predsym, n.nodeList.dup()}
 }
@@ -228,45 +292,159 @@ func (n *leafNode) Copy() node {
 	return &leafNode{n.nodeType, n.pos, n.val}
 }
 
+// ParseError describes a syntax error and where it occurred in the input.
+type ParseError struct {
+	Name   string // name of the input source
+	Offset int    // byte offset, counting from 0
+	Line   int    // line number, counting from 1
+	Col    int    // column number, in runes, counting from 1
+	Msg    string // description of the error
+	Text   string // the line of input containing the error, without newline
+}
+
+func newParseError(name, input string, p pos, msg string) *ParseError {
+	start := strings.LastIndex(input[:p.offset], "\n") + 1
+	end := strings.IndexByte(input[p.offset:], '\n')
+	if end < 0 {
+		end = len(input)
+	} else {
+		end += p.offset
+	}
+	text := strings.TrimSuffix(input[start:end], "\r")
+	return &ParseError{name, p.offset, p.line, p.col, msg, text}
+}
+
+// Error returns a message of the form "datalog: name:line:col: msg", followed
+// by an excerpt of the input.
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("datalog: %s:%d:%d: %s\n%s", e.Name, e.Line, e.Col, e.Msg, e.Excerpt())
+}
+
+// Excerpt returns the line of input containing the error, indented by a tab,
+// then a second line with a caret marking the column where the error occurred.
+func (e *ParseError) Excerpt() string {
+	caret := make([]rune, 0, e.Col)
+	for i, r := range []rune(e.Text) {
+		if i+1 >= e.Col {
+			break
+		}
+		if r == '\t' {
+			caret = append(caret, '\t')
+		} else {
+			caret = append(caret, ' ')
+		}
+	}
+	return "\t" + e.Text + "\n\t" + string(caret) + "^"
+}
+
+// ParseErrors is a list of syntax errors, in the order they occur in the input.
+type ParseErrors []*ParseError
+
+// Error returns the messages of all the errors, separated by newlines.
+func (e ParseErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
 // parser holds the state of the recursive descent parser.
 type parser struct {
 	lex   *lexer
-	pos   pos
+	pos   pos   // position of token.
 	token token // single-token lookahead.
+	depth int   // number of parentheses left open before token.
 }
 
 func (parser *parser) next() {
-	parser.pos = pos(parser.lex.pos)
+	switch parser.token.typ {
+	case itemLP:
+		parser.depth++
+	case itemRP:
+		if parser.depth > 0 {
+			parser.depth--
+		}
+	}
 	parser.token = parser.lex.nextToken()
+	parser.pos = parser.token.pos
+}
+
+// errorf returns a ParseError at the position of the lookahead token. If the
+// lexer failed, its error is returned instead.
+func (parser *parser) errorf(format string, args ...interface{}) error {
+	if parser.token.typ == itemError {
+		return parser.errorAt(parser.pos, "%s", parser.token.val)
+	}
+	return parser.errorAt(parser.pos, format, args...)
+}
+
+// errorAt returns a ParseError at the given position.
+func (parser *parser) errorAt(p pos, format string, args ...interface{}) error {
+	return newParseError(parser.lex.name, parser.lex.input, p, fmt.Sprintf(format, args...))
 }
 
 func (parser *parser) parseTerm() (node, error) {
-	var n node
-	switch parser.token.typ {
+	n, err := parser.term(parser.token)
+	if err != nil {
+		return nil, err
+	}
+	parser.next()
+	return n, nil
+}
+
+// term returns a leaf node for a variable or constant token.
+func (parser *parser) term(t token) (node, error) {
+	switch t.typ {
 	case itemVariable:
-		n = newLeaf(nodeVariable, parser.pos, parser.token.val)
+		return newLeaf(nodeVariable, t.pos, t.val), nil
 	case itemIdentifier:
-		n = newLeaf(nodeIdentifier, parser.pos, parser.token.val)
+		return newLeaf(nodeIdentifier, t.pos, t.val), nil
+	case itemNumber:
+		n, err := strconv.ParseInt(t.val, 10, 64)
+		if err != nil {
+			return nil, parser.errorAt(t.pos, "invalid number: %v", t.val)
+		}
+		return newLeaf(nodeNumber, t.pos, strconv.FormatInt(n, 10)), nil
 	case itemString:
-		s, err := strconv.Unquote(parser.token.val)
+		s, err := strconv.Unquote(t.val)
 		if err != nil {
-			return nil, fmt.Errorf("datalog: improperly quoted string: %v", parser.token.val)
+			return nil, parser.errorAt(t.pos, "improperly quoted string: %v", t.val)
 		}
-		n = newLeaf(nodeString, parser.pos, s)
+		return newLeaf(nodeString, t.pos, s), nil
 	default:
-		return nil, fmt.Errorf("datalog: expecting variable or constant, found: %v", parser.token)
+		return nil, parser.errorf("expecting variable or constant, found: %v", parser.token)
 	}
-	parser.next()
-	return n, nil
 }
 
 func (parser *parser) parseLiteral() (*literalNode, error) {
-	if parser.token.typ != itemIdentifier && parser.token.typ != itemString {
-		return nil, fmt.Errorf("datalog: expecting identifier or string, found: %v", parser.token)
+	first := parser.token
+	switch first.typ {
+	case itemVariable:
+		lhs, err := parser.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		return parser.parseInfix(lhs)
+	case itemIdentifier, itemString, itemNumber:
+	default:
+		if !first.infix() {
+			return nil, parser.errorf("expecting identifier or string, found: %v", parser.token)
+		}
 	}
-	literal := newLiteral(parser.pos, parser.token.val)
 	parser.next()
+	if !first.infix() && parser.token.infix() {
+		lhs, err := parser.term(first)
+		if err != nil {
+			return nil, err
+		}
+		return parser.parseInfix(lhs)
+	}
+	literal := newLiteral(first.pos, first.val)
 	if parser.token.typ != itemLP {
+		if first.infix() {
+			return nil, parser.errorf("expecting '(', found: %v", parser.token)
+		}
 		return literal, nil
 	}
 	parser.next()
@@ -277,7 +455,7 @@ func (parser *parser) parseLiteral() (*literalNode, error) {
 	literal.append(term)
 	for parser.token.typ != itemRP {
 		if parser.token.typ != itemComma {
-			return nil, fmt.Errorf("datalog: expecting ',' or ')', found: %v", parser.token)
+			return nil, parser.errorf("expecting ',' or ')', found: %v", parser.token)
 		}
 		parser.next()
 		term, err = parser.parseTerm()
@@ -290,51 +468,222 @@ func (parser *parser) parseLiteral() (*literalNode, error) {
 	return literal, nil
 }
 
-func parse(name, input string) (*programNode, error) {
-	l := lex(name, input)
-	parser := &parser{lex: l}
+// parseInfix parses the operator and right-hand side of an infix literal, like
+// X = Y or X < 7, given its left-hand side.
+func (parser *parser) parseInfix(lhs node) (*literalNode, error) {
+	if !parser.token.infix() {
+		return nil, parser.errorf("expecting operator, found: %v", parser.token)
+	}
+	literal := newLiteral(lhs.Position(), parser.token.val)
 	parser.next()
-	pgm := newProgram(parser.pos)
+	rhs, err := parser.parseTerm()
+	if err != nil {
+		return nil, err
+	}
+	if literal.predsym == "=" && parser.token.typ == itemIdentifier && arithOps[parser.token.val] {
+		// Z = X + Y is written +(X, Y, Z).
+		literal.predsym = parser.token.val
+		parser.next()
+		arg, err := parser.parseTerm()
+		if err != nil {
+			return nil, err
+		}
+		literal.append(rhs)
+		literal.append(arg)
+		literal.append(lhs)
+		return literal, nil
+	}
+	literal.append(lhs)
+	literal.append(rhs)
+	return literal, nil
+}
+
+// parseBody parses the body literals, if any, following a clause's head.
+func (parser *parser) parseBody(clause *clauseNode) error {
+	if parser.token.typ != itemWhen {
+		return nil
+	}
+	parser.next()
+	body, err := parser.parseLiteral()
+	if err != nil {
+		return err
+	}
+	clause.append(body)
+	for parser.token.typ == itemComma {
+		parser.next()
+		body, err = parser.parseLiteral()
+		if err != nil {
+			return err
+		}
+		clause.append(body)
+	}
+	return nil
+}
+
+// parseAssumptions parses a sequence of clauses, each ending in '.', between
+// braces, then the query literal that follows.
+func (parser *parser) parseAssumptions() (*queryNode, error) {
+	pos := parser.pos
+	parser.next()
+	assumed := nodeList{}
+	for parser.token.typ != itemRBrace {
+		head, err := parser.parseLiteral()
+		if err != nil {
+			return nil, err
+		}
+		clause := newClause(head.pos, head)
+		if err := parser.parseBody(clause); err != nil {
+			return nil, err
+		}
+		if parser.token.typ != itemDot {
+			return nil, parser.errorf("expecting '.', found: %v", parser.token)
+		}
+		parser.next()
+		assumed.append(clause)
+	}
+	parser.next()
+	literal, err := parser.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	if parser.token.typ != itemQuestion {
+		return nil, parser.errorf("expecting '?', found: %v", parser.token)
+	}
+	parser.next()
+	return newQuery(pos, literal, assumed), nil
+}
+
+// parseDirective parses a directive, starting from the '.' that introduces it.
+func (parser *parser) parseDirective() (*directiveNode, error) {
+	pos := parser.pos
+	parser.next()
+	directive := parser.token.val
+	if parser.token.typ != itemIdentifier || (directive != "input" && directive != "output") {
+		return nil, parser.errorf("expecting input or output directive, found: %v", parser.token)
+	}
+	parser.next()
+	literal, err := parser.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	if parser.token.typ != itemString {
+		return nil, parser.errorf("expecting file name, found: %v", parser.token)
+	}
+	file, err := strconv.Unquote(parser.token.val)
+	if err != nil {
+		return nil, parser.errorf("improperly quoted string: %v", parser.token.val)
+	}
+	parser.next()
+	return newDirective(pos, directive, literal, file), nil
+}
+
+// parseStatement parses an assertion, retraction, query, or directive.
+func (parser *parser) parseStatement() (node, error) {
+	switch parser.token.typ {
+	case itemLBrace:
+		return parser.parseAssumptions()
+	case itemDot:
+		return parser.parseDirective()
+	}
+	literal, err := parser.parseLiteral()
+	if err != nil {
+		return nil, err
+	}
+	if parser.token.typ == itemQuestion {
+		parser.next()
+		return newQuery(literal.pos, literal, nil), nil
+	}
+	clause := newClause(literal.pos, literal)
+	if err := parser.parseBody(clause); err != nil {
+		return nil, err
+	}
+	var action actionType
+	switch parser.token.typ {
+	case itemDot:
+		action = actionAssert
+	case itemTilde:
+		action = actionRetract
+	case itemTildeTilde:
+		if len(clause.nodeList) > 0 {
+			return nil, parser.errorAt(clause.pos, "can't retract rules by pattern: %v", clause)
+		}
+		action = actionRetractMatching
+	default:
+		return nil, parser.errorf("unexpected: %v", parser.token)
+	}
+	parser.next()
+	return newAction(clause.pos, clause, action), nil
+}
+
+// recover skips the remainder of a statement, beginning with the given token,
+// after a syntax error. Statements end after '.', '~', '~~', or '?', except
+// that queries with assumptions end only after '?', and directives end after
+// the file name or before the next '.'. A '?' inside parentheses, as in p(?),
+// doesn't end a statement, but parentheses left open are forgotten at the next
+// '.' or line, so they don't swallow later queries. Parsing can't resume after
+// a lexer error, so recover reports whether there is more input to parse.
+func (parser *parser) recover(start itemType) bool {
 	for {
 		switch parser.token.typ {
-		case itemEOF:
-			return pgm, nil
-		default:
-			literal, err := parser.parseLiteral()
-			if err != nil {
-				return nil, err
-			}
-			if parser.token.typ == itemQuestion {
-				pgm.append(newQuery(parser.pos, literal))
+		case itemEOF, itemError:
+			return false
+		case itemQuestion:
+			if parser.depth == 0 {
 				parser.next()
-			} else {
-				clause := newClause(parser.pos, literal)
-				if parser.token.typ == itemWhen {
-					parser.next()
-					body, err := parser.parseLiteral()
-					if err != nil {
-						return nil, err
-					}
-					clause.append(body)
-					for parser.token.typ == itemComma {
-						parser.next()
-						body, err = parser.parseLiteral()
-						if err != nil {
-							return nil, err
-						}
-						clause.append(body)
-					}
-				}
-				if parser.token.typ == itemDot {
-					pgm.append(newAction(parser.pos, clause, actionAssert))
-					parser.next()
-				} else if parser.token.typ == itemTilde {
-					pgm.append(newAction(parser.pos, clause, actionRetract))
-					parser.next()
-				} else {
-					return nil, fmt.Errorf("datalog: unexpected: %v", parser.token)
+				return true
+			}
+		case itemDot, itemTilde, itemTildeTilde:
+			if parser.token.typ == itemDot {
+				parser.depth = 0
+				if start == itemDot {
+					return true
 				}
 			}
+			if start != itemLBrace {
+				parser.next()
+				return true
+			}
+		case itemString:
+			if start == itemDot {
+				parser.next()
+				return true
+			}
+		}
+		line := parser.pos.line
+		parser.next()
+		if parser.pos.line != line {
+			parser.depth = 0
+		}
+	}
+}
+
+// parse parses the input. If there are syntax errors, parsing resumes after
+// the statement containing each one, and all of them are returned together as
+// ParseErrors.
+func parse(name, input string) (*programNode, error) {
+	l := lex(name, input)
+	parser := &parser{lex: l}
+	parser.next()
+	pgm := newProgram(parser.pos)
+	var errs ParseErrors
+	for parser.token.typ != itemEOF {
+		parser.depth = 0
+		start := parser.token.typ
+		n, err := parser.parseStatement()
+		if err == nil {
+			pgm.append(n)
+			continue
+		}
+		errs = append(errs, err.(*ParseError))
+		if !parser.recover(start) {
+			break
 		}
 	}
+	if parser.token.typ == itemError && (errs == nil || errs[len(errs)-1].Offset != parser.pos.offset) {
+		errs = append(errs, parser.errorf("").(*ParseError))
+	}
+	if errs != nil {
+		return nil, errs
+	}
+	return pgm, nil
 }
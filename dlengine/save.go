@@ -0,0 +1,457 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlengine
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"strconv"
+
+	"github.com/kevinawalsh/datalog"
+)
+
+// The binary snapshot format written by Save is:
+//   magic   "DLSNAP"
+//   version uvarint
+//   terms   uvarint count, then for each: kind byte, string
+//           (for numbers, the string is the integer in decimal)
+//   preds   uvarint count, then for each: string name, uvarint arity
+//   clauses uvarint count, then for each: literal head, uvarint n, n literals
+//   crc     4 bytes, big-endian CRC-32 (IEEE) of everything above
+// where a string is a uvarint length followed by that many bytes, and a literal
+// is a uvarint pred index followed by one uvarint term index per argument.
+
+const snapshotMagic = "DLSNAP"
+
+// snapshotVersion is the version of the binary snapshot format written by Save.
+// Version 1 had no numbers, so Restore reads identifiers like 7 in version 1
+// snapshots as numbers.
+const snapshotVersion = 2
+
+// Term kinds in binary snapshots.
+const (
+	snapIdent  byte = 'i'
+	snapQuoted byte = 'q'
+	snapNumber byte = 'n'
+	snapVar    byte = 'v'
+)
+
+// ErrCorruptSnapshot is returned by Restore if a snapshot is truncated or fails
+// its checksum.
+var ErrCorruptSnapshot = errors.New("datalog: corrupt snapshot")
+
+// Save writes every fact and rule in the engine's database to w in a compact
+// binary format that can be loaded again with Restore. This is much faster to
+// load than the equivalent datalog text. Only terms created by the engine, i.e.
+// Ident, Quoted, Number, and Var, can be saved.
+func (e *Engine) Save(w io.Writer) error {
+	enc := &snapEncoder{
+		terms: make(map[datalog.Term]int),
+		preds: make(map[datalog.Pred]int),
+	}
+	e.mu.RLock()
+	preds := make([]datalog.Pred, 0, len(e.Pred))
+	for _, p := range e.Pred {
+		preds = append(preds, p)
+	}
+	e.mu.RUnlock()
+	for _, p := range preds {
+		if db, ok := p.(interface {
+			Clauses() ([]*datalog.Clause, error)
+		}); ok {
+			clauses, err := db.Clauses()
+			if err != nil {
+				return err
+			}
+			enc.clauses = append(enc.clauses, clauses...)
+		}
+	}
+	for _, c := range enc.clauses {
+		if err := enc.index(c); err != nil {
+			return err
+		}
+	}
+
+	crc := crc32.NewIEEE()
+	out := bufio.NewWriter(w)
+	enc.w = io.MultiWriter(out, crc)
+	enc.writeBytes([]byte(snapshotMagic))
+	enc.writeUvarint(snapshotVersion)
+	enc.writeUvarint(uint64(len(enc.termList)))
+	for _, t := range enc.termList {
+		switch t := t.(type) {
+		case *Ident:
+			enc.writeBytes([]byte{snapIdent})
+			enc.writeString(t.Value)
+		case *Quoted:
+			enc.writeBytes([]byte{snapQuoted})
+			enc.writeString(t.Value)
+		case *Number:
+			enc.writeBytes([]byte{snapNumber})
+			enc.writeString(t.String())
+		case *Var:
+			enc.writeBytes([]byte{snapVar})
+			enc.writeString(t.Name)
+		}
+	}
+	enc.writeUvarint(uint64(len(enc.predList)))
+	for _, p := range enc.predList {
+		enc.writeString(fmt.Sprintf("%v", p))
+		enc.writeUvarint(uint64(p.Arity()))
+	}
+	enc.writeUvarint(uint64(len(enc.clauses)))
+	for _, c := range enc.clauses {
+		enc.writeLiteral(c.Head)
+		enc.writeUvarint(uint64(len(c.Body)))
+		for _, l := range c.Body {
+			enc.writeLiteral(l)
+		}
+	}
+	if enc.err != nil {
+		return enc.err
+	}
+	if err := binary.Write(out, binary.BigEndian, crc.Sum32()); err != nil {
+		return err
+	}
+	return out.Flush()
+}
+
+// snapEncoder holds the state needed to write a binary snapshot.
+type snapEncoder struct {
+	w        io.Writer
+	err      error
+	buf      [binary.MaxVarintLen64]byte
+	clauses  []*datalog.Clause
+	terms    map[datalog.Term]int
+	termList []datalog.Term
+	preds    map[datalog.Pred]int
+	predList []datalog.Pred
+}
+
+// index assigns numbers to the predicates and terms in c.
+func (enc *snapEncoder) index(c *datalog.Clause) error {
+	if err := enc.indexLiteral(c.Head); err != nil {
+		return err
+	}
+	for _, l := range c.Body {
+		if err := enc.indexLiteral(l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (enc *snapEncoder) indexLiteral(l *datalog.Literal) error {
+	if _, ok := enc.preds[l.Pred]; !ok {
+		enc.preds[l.Pred] = len(enc.predList)
+		enc.predList = append(enc.predList, l.Pred)
+	}
+	for _, t := range l.Arg {
+		if _, ok := enc.terms[t]; ok {
+			continue
+		}
+		switch t.(type) {
+		case *Ident, *Quoted, *Number, *Var:
+		default:
+			return fmt.Errorf("datalog: can't save term %v of type %T", t, t)
+		}
+		enc.terms[t] = len(enc.termList)
+		enc.termList = append(enc.termList, t)
+	}
+	return nil
+}
+
+func (enc *snapEncoder) writeBytes(b []byte) {
+	if enc.err == nil {
+		_, enc.err = enc.w.Write(b)
+	}
+}
+
+func (enc *snapEncoder) writeUvarint(x uint64) {
+	n := binary.PutUvarint(enc.buf[:], x)
+	enc.writeBytes(enc.buf[:n])
+}
+
+func (enc *snapEncoder) writeString(s string) {
+	enc.writeUvarint(uint64(len(s)))
+	enc.writeBytes([]byte(s))
+}
+
+func (enc *snapEncoder) writeLiteral(l *datalog.Literal) {
+	enc.writeUvarint(uint64(enc.preds[l.Pred]))
+	for _, t := range l.Arg {
+		enc.writeUvarint(uint64(enc.terms[t]))
+	}
+}
+
+// Restore reads a binary snapshot written by Save and adds every fact and rule
+// it contains to the engine's database. Predicates are matched by name and
+// arity, so custom predicates, other than those added by NewEngine, should be
+// added to the engine before calling Restore. Snapshots that are corrupt, or
+// that were written in an unsupported format, are rejected before the database
+// is modified. The clauses were safe when saved, so they are not checked again.
+func (e *Engine) Restore(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) < len(snapshotMagic)+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return errors.New("datalog: not a snapshot")
+	}
+	n := len(data) - 4
+	if crc32.ChecksumIEEE(data[:n]) != binary.BigEndian.Uint32(data[n:]) {
+		return ErrCorruptSnapshot
+	}
+	dec := &snapDecoder{data: data[:n], pos: len(snapshotMagic)}
+	version := dec.readUvarint()
+	if dec.err == nil && version != 1 && version != snapshotVersion {
+		return fmt.Errorf("datalog: unsupported snapshot version %d", version)
+	}
+
+	// Decode everything before touching the engine.
+	type termEntry struct {
+		kind byte
+		val  string
+	}
+	terms := make([]termEntry, dec.readCount())
+	for i := range terms {
+		terms[i].kind = dec.readByte()
+		terms[i].val = dec.readString()
+		switch terms[i].kind {
+		case snapIdent, snapQuoted, snapVar:
+		case snapNumber:
+			if n, ok := isNumber(terms[i].val); ok && version > 1 {
+				terms[i].val = n
+			} else if dec.err == nil {
+				dec.err = ErrCorruptSnapshot
+			}
+		default:
+			if dec.err == nil {
+				dec.err = ErrCorruptSnapshot
+			}
+		}
+		if terms[i].kind == snapIdent && version == 1 {
+			if n, ok := isNumber(terms[i].val); ok {
+				terms[i].kind, terms[i].val = snapNumber, n
+			}
+		}
+	}
+	type predEntry struct {
+		name  string
+		arity int
+	}
+	preds := make([]predEntry, dec.readCount())
+	for i := range preds {
+		preds[i].name = dec.readString()
+		preds[i].arity = dec.readArity()
+	}
+	type literalEntry struct {
+		pred int
+		arg  []int
+	}
+	readLiteral := func() literalEntry {
+		l := literalEntry{pred: dec.readIndex(len(preds))}
+		if dec.err != nil {
+			return l
+		}
+		l.arg = make([]int, preds[l.pred].arity)
+		for i := range l.arg {
+			l.arg[i] = dec.readIndex(len(terms))
+		}
+		return l
+	}
+	clauses := make([][]literalEntry, dec.readCount())
+	for i := range clauses {
+		head := readLiteral()
+		body := make([]literalEntry, dec.readCount())
+		for j := range body {
+			body[j] = readLiteral()
+		}
+		clauses[i] = append([]literalEntry{head}, body...)
+	}
+	if dec.err == nil && dec.pos != len(dec.data) {
+		dec.err = ErrCorruptSnapshot
+	}
+	if dec.err != nil {
+		return dec.err
+	}
+
+	// Map everything to existing or new engine objects, then assert.
+	e.mu.Lock()
+	termObjs := make([]datalog.Term, len(terms))
+	for i, t := range terms {
+		var key string
+		switch t.kind {
+		case snapIdent, snapNumber:
+			key = t.val
+		case snapQuoted:
+			key = strconv.Quote(t.val)
+		case snapVar:
+			key = t.val
+		}
+		obj, ok := e.Term[key]
+		if !ok {
+			switch t.kind {
+			case snapIdent:
+				obj = NewIdent(t.val)
+			case snapQuoted:
+				obj = NewQuoted(t.val)
+			case snapNumber:
+				v, _ := strconv.ParseInt(t.val, 10, 64)
+				obj = NewNumber(v)
+			case snapVar:
+				obj = NewVar(t.val)
+			}
+			e.Term[key] = obj
+		}
+		termObjs[i] = obj
+	}
+	predObjs := make([]datalog.Pred, len(preds))
+	for i, p := range preds {
+		id := p.name + "/" + strconv.Itoa(p.arity)
+		obj, ok := e.Pred[id]
+		if !ok {
+			obj = NewPred(p.name, p.arity)
+			e.Pred[id] = obj
+		}
+		predObjs[i] = obj
+	}
+	e.mu.Unlock()
+
+	literal := func(l literalEntry) *datalog.Literal {
+		arg := make([]datalog.Term, len(l.arg))
+		for i, t := range l.arg {
+			arg[i] = termObjs[t]
+		}
+		return datalog.NewLiteral(predObjs[l.pred], arg...)
+	}
+	// Every clause was checked for safety when it was first asserted, so skip
+	// Clause.Assert and insert directly. Reference counts are tallied by
+	// snapshot index and added to the engine's counts at the end.
+	termRefs := make([]int, len(terms))
+	predRefs := make([]int, len(preds))
+	for _, lits := range clauses {
+		body := make([]*datalog.Literal, len(lits)-1)
+		for i, l := range lits[1:] {
+			body[i] = literal(l)
+		}
+		c := NewRule(literal(lits[0]), body...)
+		var added bool
+		added, err = c.Head.Pred.Assert(c)
+		if err != nil {
+			break
+		}
+		if added {
+			for _, l := range lits {
+				predRefs[l.pred]++
+				for _, t := range l.arg {
+					termRefs[t]++
+				}
+			}
+		}
+	}
+	e.mu.Lock()
+	for i, n := range termRefs {
+		if n > 0 {
+			e.trackObject(termObjs[i], n)
+		}
+	}
+	for i, n := range predRefs {
+		if n > 0 {
+			e.trackObject(predObjs[i], n)
+		}
+	}
+	e.mu.Unlock()
+	return err
+}
+
+// snapDecoder holds the state needed to read a binary snapshot.
+type snapDecoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (dec *snapDecoder) readByte() byte {
+	if dec.err != nil {
+		return 0
+	}
+	if dec.pos >= len(dec.data) {
+		dec.err = ErrCorruptSnapshot
+		return 0
+	}
+	b := dec.data[dec.pos]
+	dec.pos++
+	return b
+}
+
+func (dec *snapDecoder) readUvarint() uint64 {
+	if dec.err != nil {
+		return 0
+	}
+	x, n := binary.Uvarint(dec.data[dec.pos:])
+	if n <= 0 {
+		dec.err = ErrCorruptSnapshot
+		return 0
+	}
+	dec.pos += n
+	return x
+}
+
+// readCount reads a length or count, which can't exceed the remaining data.
+func (dec *snapDecoder) readCount() int {
+	x := dec.readUvarint()
+	if dec.err == nil && x > uint64(len(dec.data)-dec.pos) {
+		dec.err = ErrCorruptSnapshot
+		return 0
+	}
+	return int(x)
+}
+
+// readArity reads an arity, which can't exceed the size of the data, since each
+// literal holds one or more bytes per argument.
+func (dec *snapDecoder) readArity() int {
+	x := dec.readUvarint()
+	if dec.err == nil && x > uint64(len(dec.data)) {
+		dec.err = ErrCorruptSnapshot
+		return 0
+	}
+	return int(x)
+}
+
+// readIndex reads an index, which must be less than n.
+func (dec *snapDecoder) readIndex(n int) int {
+	x := dec.readUvarint()
+	if dec.err == nil && x >= uint64(n) {
+		dec.err = ErrCorruptSnapshot
+		return 0
+	}
+	return int(x)
+}
+
+func (dec *snapDecoder) readString() string {
+	n := dec.readCount()
+	if dec.err != nil {
+		return ""
+	}
+	s := string(dec.data[dec.pos : dec.pos+n])
+	dec.pos += n
+	return s
+}
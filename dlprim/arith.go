@@ -0,0 +1,264 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlprim
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+
+	"github.com/kevinawalsh/datalog"
+)
+
+// ConstFactory creates the constants in facts discovered by primitives that
+// compute new values, like Plus and Concat. Since the prover compares constants
+// by identity, an engine should supply a ConstFactory that returns the same
+// objects it uses for the same values. The dlengine.Engine type is a
+// ConstFactory, which it supplies to each FactoryPred added to it.
+type ConstFactory interface {
+	NewInteger(v int64) Integer
+
+	// NewString returns a string constant with value v. The constant should be
+	// an identifier if ident is set and v is a valid identifier, and a quoted
+	// string otherwise.
+	NewString(v string, ident bool) StringConst
+}
+
+// FactoryPred is implemented by custom predicates that use a ConstFactory, like
+// Plus and Concat, so that an engine can supply its own. The dlengine.Engine
+// AddPred method adds WithFactory(e) in place of such a predicate, for engine e.
+type FactoryPred interface {
+	datalog.Pred
+
+	// WithFactory returns a predicate like this one that uses f to create the
+	// constants it discovers.
+	WithFactory(f ConstFactory) datalog.Pred
+}
+
+// ModeError reports a search by a primitive whose arguments are not bound to
+// constants of the required type.
+type ModeError struct {
+	Target *datalog.Literal // the literal being searched
+	Msg    string           // description of the requirement, e.g. "argument 1 must be bound"
+}
+
+func (e *ModeError) Error() string {
+	return "datalog: " + pattern(e.Target) + ": " + e.Msg
+}
+
+// pattern returns target as a string in which each variable is written as _,
+// since the prover searches for literals with renamed variables, which have no
+// meaningful names.
+func pattern(target *datalog.Literal) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%v", target.Pred)
+	for i, arg := range target.Arg {
+		if i == 0 {
+			buf.WriteString("(")
+		} else {
+			buf.WriteString(", ")
+		}
+		if arg.Variable() {
+			buf.WriteString("_")
+		} else {
+			fmt.Fprintf(&buf, "%v", arg)
+		}
+	}
+	if len(target.Arg) > 0 {
+		buf.WriteString(")")
+	}
+	return buf.String()
+}
+
+// Plus is a custom predicate for integer addition, defined by these rules:
+//   +(c1, c2, Z) generates fact +(c1, c2, c3), where c3 = c1 + c2.
+//   +(c1, c2, c3) generates fact +(c1, c2, c3) if c3 = c1 + c2.
+// There is no fact if c1 or c2 is not an Integer constant, or if the result
+// overflows. If the first two arguments are not bound, the search fails with an
+// error. In the body of a rule, a literal is delayed until they are bound (see
+// datalog.Moded). In dlengine syntax, +(X, Y, Z) is written Z = X + Y.
+var Plus datalog.Pred
+
+// Minus is a custom predicate for integer subtraction, written Z = X - Y. See
+// Plus.
+var Minus datalog.Pred
+
+// Times is a custom predicate for integer multiplication, written Z = X * Y. See
+// Plus.
+var Times datalog.Pred
+
+// Div is a custom predicate for integer division, written Z = X / Y. The
+// quotient is truncated toward zero, and there is no fact if Y is zero. See
+// Plus.
+var Div datalog.Pred
+
+// Mod is a custom predicate for the integer remainder, written Z = X mod Y. The
+// result has the sign of X, and there is no fact if Y is zero. See Plus.
+var Mod datalog.Pred
+
+func init() {
+	preds := Arithmetic(defaultFactory{})
+	Plus, Minus, Times, Div, Mod = preds[0], preds[1], preds[2], preds[3], preds[4]
+}
+
+// Arithmetic returns new instances of Plus, Minus, Times, Div, and Mod, in that
+// order, that use f to create the constants they discover. The instances in
+// package variables, like Plus, create new constants for each result, unless
+// replaced using WithFactory.
+func Arithmetic(f ConstFactory) []datalog.Pred {
+	return []datalog.Pred{
+		newArithPrim("+", f, plus),
+		newArithPrim("-", f, minus),
+		newArithPrim("*", f, times),
+		newArithPrim("/", f, div),
+		newArithPrim("mod", f, mod),
+	}
+}
+
+var errOverflow = errors.New("integer overflow")
+var errDivideByZero = errors.New("division by zero")
+
+func plus(x, y int64) (int64, error) {
+	z := x + y
+	if (x^z)&(y^z) < 0 {
+		return 0, errOverflow
+	}
+	return z, nil
+}
+
+func minus(x, y int64) (int64, error) {
+	z := x - y
+	if (x^y)&(x^z) < 0 {
+		return 0, errOverflow
+	}
+	return z, nil
+}
+
+func times(x, y int64) (int64, error) {
+	if x == 0 || y == 0 {
+		return 0, nil
+	}
+	z := x * y
+	if z/y != x || (x == -1 && y == math.MinInt64) || (y == -1 && x == math.MinInt64) {
+		return 0, errOverflow
+	}
+	return z, nil
+}
+
+func div(x, y int64) (int64, error) {
+	if y == 0 {
+		return 0, errDivideByZero
+	}
+	if x == math.MinInt64 && y == -1 {
+		return 0, errOverflow
+	}
+	return x / y, nil
+}
+
+func mod(x, y int64) (int64, error) {
+	if y == 0 {
+		return 0, errDivideByZero
+	}
+	if y == -1 {
+		return 0, nil
+	}
+	return x % y, nil
+}
+
+// defaultFactory creates a new constant for each value.
+type defaultFactory struct{}
+
+func (defaultFactory) NewInteger(v int64) Integer {
+	return &intConst{v: v}
+}
+
+// intConst is an integer constant created by defaultFactory.
+type intConst struct {
+	v int64
+	datalog.DistinctConst
+}
+
+func (c *intConst) String() string {
+	return strconv.FormatInt(c.v, 10)
+}
+
+func (c *intConst) Int64() int64 {
+	return c.v
+}
+
+type arithPrim struct {
+	ReadOnly
+	op      string
+	factory ConstFactory
+	compute func(x, y int64) (int64, error)
+}
+
+func newArithPrim(op string, f ConstFactory, compute func(x, y int64) (int64, error)) *arithPrim {
+	p := &arithPrim{op: op, factory: f, compute: compute}
+	p.SetArity(3)
+	return p
+}
+
+func (p *arithPrim) String() string {
+	return p.op
+}
+
+func (p *arithPrim) WithFactory(f ConstFactory) datalog.Pred {
+	q := *p
+	q.factory = f
+	return &q
+}
+
+func (p *arithPrim) Modes() []datalog.Mode {
+	return []datalog.Mode{newMode("bbf", primCost)}
+}
+
+// Check returns an error unless the first two arguments of target are bound.
+func (p *arithPrim) Check(target *datalog.Literal) error {
+	for i := 0; i < 2; i++ {
+		if target.Arg[i].Variable() {
+			return &ModeError{target, fmt.Sprintf("argument %d must be bound", i+1)}
+		}
+	}
+	return nil
+}
+
+func (p *arithPrim) Search(target *datalog.Literal, discovered func(c *datalog.Clause)) {
+	x, ok := target.Arg[0].(Integer)
+	if !ok {
+		return
+	}
+	y, ok := target.Arg[1].(Integer)
+	if !ok {
+		return
+	}
+	z, err := p.compute(x.Int64(), y.Int64())
+	if err != nil {
+		return
+	}
+	switch t := target.Arg[2].(type) {
+	case Integer:
+		if t.Int64() == z {
+			discovered(datalog.NewClause(target))
+		}
+	default:
+		if t.Variable() {
+			result := p.factory.NewInteger(z)
+			discovered(datalog.NewClause(datalog.NewLiteral(p, target.Arg[0], target.Arg[1], result)))
+		}
+	}
+}
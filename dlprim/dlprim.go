@@ -12,7 +12,9 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-// Package dlprim provides custom "primitive" datalog predicates, like Equals.
+// Package dlprim provides custom "primitive" datalog predicates, like Equals,
+// NotEquals, and Less, along with NewFunc and NewTable, for building custom
+// predicates from Go functions and data.
 package dlprim
 
 import (
@@ -27,28 +29,136 @@ import (
 //   =(c, Y) generates fact =(c, c).
 //   =(c, c) generates fact =(c, c).
 //   =(c1, c2) generates no facts.
+// In the body of a rule, =(X, Y) is delayed until X or Y is bound (see
+// datalog.Moded).
 var Equals datalog.Pred
 
+// NotEquals is a custom predicate for inequality checking, defined by these
+// rules:
+//   !=(X, Y), !=(X, c), and !=(c, Y) generate no facts.
+//   !=(c, c) generates no facts.
+//   !=(c1, c2) generates fact !=(c1, c2).
+// In the body of a rule, a literal with variables is delayed until they are
+// bound (see datalog.Moded).
+var NotEquals datalog.Pred
+
+// Integer is implemented by constants that have an integer value, like
+// dlengine.Number. Only Integer constants can be compared by Less and the other
+// comparison predicates.
+type Integer interface {
+	datalog.Const
+	Int64() int64
+}
+
+// Less is a custom predicate for comparing integers, defined by these rules:
+//   <(X, Y), <(X, c), and <(c, Y) generate no facts.
+//   <(c1, c2) generates fact <(c1, c2) if c1 and c2 are Integer constants
+//   and c1 < c2.
+// In the body of a rule, a literal with variables is delayed until they are
+// bound (see datalog.Moded). LessOrEqual, Greater, and GreaterOrEqual are
+// similar, but for <=, >, and >=.
+var Less datalog.Pred
+
+// LessOrEqual is a custom predicate for comparing integers. See Less.
+var LessOrEqual datalog.Pred
+
+// Greater is a custom predicate for comparing integers. See Less.
+var Greater datalog.Pred
+
+// GreaterOrEqual is a custom predicate for comparing integers. See Less.
+var GreaterOrEqual datalog.Pred
+
+// primCost is the estimated cost of a search for most primitives, which is low
+// compared to a database search.
+const primCost = 0.1
+
+// ReadOnly can be embedded in custom predicates whose facts are generated by
+// Search rather than held in a database, like the primitives in this package.
+// It embeds datalog.DistinctPred, and its Assert and Retract always fail, so a
+// predicate like this one needs only a Search method and a call to SetArity:
+//   type weekday struct {
+//     dlprim.ReadOnly
+//   }
+type ReadOnly struct {
+	datalog.DistinctPred
+}
+
+// Assert fails, since a read-only predicate has no database to add to.
+func (p *ReadOnly) Assert(c *datalog.Clause) (bool, error) {
+	return false, errors.New("datalog: can't assert for custom predicates")
+}
+
+// Retract fails, since a read-only predicate has no database to remove from.
+func (p *ReadOnly) Retract(c *datalog.Clause) ([]*datalog.Clause, error) {
+	return nil, errors.New("datalog: can't retract for custom predicates")
+}
+
+func newMode(pattern string, cost float64) datalog.Mode {
+	return datalog.Mode{Pattern: pattern, Cost: cost}
+}
+
+// consistent checks whether args, the arguments of a fact found for target,
+// give the same value to each occurrence of a variable in target, comparing
+// integers and strings by value. If so, later occurrences are replaced by the
+// first, so the fact unifies with target.
+func consistent(target *datalog.Literal, args []datalog.Term) bool {
+	for i, t := range target.Arg {
+		if !t.Variable() {
+			continue
+		}
+		for j := i + 1; j < len(args); j++ {
+			if target.Arg[j] != t {
+				continue
+			}
+			if !sameValue(args[i], args[j]) {
+				return false
+			}
+			args[j] = args[i]
+		}
+	}
+	return true
+}
+
+// sameValue checks whether a and b are the same constant, or integers or
+// strings with the same value.
+func sameValue(a, b datalog.Term) bool {
+	if a == b {
+		return true
+	}
+	switch a := a.(type) {
+	case Integer:
+		b, ok := b.(Integer)
+		return ok && a.Int64() == b.Int64()
+	case StringConst:
+		b, ok := b.(StringConst)
+		return ok && a.StringValue() == b.StringValue()
+	}
+	return false
+}
+
 func init() {
 	eq := new(eqPrim)
 	eq.SetArity(2)
 	Equals = eq
+	ne := new(nePrim)
+	ne.SetArity(2)
+	NotEquals = ne
+	Less = newCmpPrim("<", func(a, b int64) bool { return a < b })
+	LessOrEqual = newCmpPrim("<=", func(a, b int64) bool { return a <= b })
+	Greater = newCmpPrim(">", func(a, b int64) bool { return a > b })
+	GreaterOrEqual = newCmpPrim(">=", func(a, b int64) bool { return a >= b })
 }
 
 type eqPrim struct {
-	datalog.DistinctPred
+	ReadOnly
 }
 
 func (eq *eqPrim) String() string {
 	return "="
 }
 
-func (eq *eqPrim) Assert(c *datalog.Clause) error {
-	return errors.New("datalog: can't assert for custom predicates")
-}
-
-func (eq *eqPrim) Retract(c *datalog.Clause) error {
-	return errors.New("datalog: can't retract for custom predicates")
+func (eq *eqPrim) Modes() []datalog.Mode {
+	return []datalog.Mode{newMode("bf", primCost), newMode("fb", primCost)}
 }
 
 func (eq *eqPrim) Search(target *datalog.Literal, discovered func(c *datalog.Clause)) {
@@ -62,3 +172,57 @@ func (eq *eqPrim) Search(target *datalog.Literal, discovered func(c *datalog.Cla
 		discovered(datalog.NewClause(target))
 	}
 }
+
+type nePrim struct {
+	ReadOnly
+}
+
+func (ne *nePrim) String() string {
+	return "!="
+}
+
+func (ne *nePrim) Modes() []datalog.Mode {
+	return []datalog.Mode{newMode("bb", primCost)}
+}
+
+func (ne *nePrim) Search(target *datalog.Literal, discovered func(c *datalog.Clause)) {
+	a := target.Arg[0]
+	b := target.Arg[1]
+	if a.Constant() && b.Constant() && a != b {
+		discovered(datalog.NewClause(target))
+	}
+}
+
+type cmpPrim struct {
+	ReadOnly
+	op    string
+	holds func(a, b int64) bool
+}
+
+func newCmpPrim(op string, holds func(a, b int64) bool) *cmpPrim {
+	cmp := &cmpPrim{op: op, holds: holds}
+	cmp.SetArity(2)
+	return cmp
+}
+
+func (cmp *cmpPrim) String() string {
+	return cmp.op
+}
+
+func (cmp *cmpPrim) Modes() []datalog.Mode {
+	return []datalog.Mode{newMode("bb", primCost)}
+}
+
+func (cmp *cmpPrim) Search(target *datalog.Literal, discovered func(c *datalog.Clause)) {
+	a, ok := target.Arg[0].(Integer)
+	if !ok {
+		return
+	}
+	b, ok := target.Arg[1].(Integer)
+	if !ok {
+		return
+	}
+	if cmp.holds(a.Int64(), b.Int64()) {
+		discovered(datalog.NewClause(target))
+	}
+}
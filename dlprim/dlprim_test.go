@@ -12,17 +12,21 @@
 // See the License for the specific language governing permissions and
 // limitations under the License.
 
-package dlprim
+package dlprim_test
 
 import (
+	"fmt"
+	"strings"
 	"testing"
 
+	"github.com/kevinawalsh/datalog"
 	"github.com/kevinawalsh/datalog/dlengine"
+	"github.com/kevinawalsh/datalog/dlprim"
 )
 
 func setup(t *testing.T, input string, asserts, retracts, queries, errors int) *dlengine.Engine {
 	e := dlengine.NewEngine()
-	e.AddPred(Equals)
+	e.AddPred(dlprim.Equals)
 	a, r, q, errs := e.Process("test", input)
 	if a != asserts || r != retracts || q != queries || errs != errors {
 		t.Fatalf("setup process failed: %d %d %d %d\ninput = %s", a, r, q, errs, input)
@@ -54,8 +58,11 @@ func TestEquals(t *testing.T) {
 	e = setup(t, "z(X) :- =(X, 0). f(X, Y) :- z(Y), =(X, Y).", 2, 0, 0, 0)
 	check(t, e, "f(X, Y)?", 1)
 
+	// A rule that never binds the arguments of = can't be satisfied.
 	e = setup(t, "e(X, Y) :- =(X, Y).", 1, 0, 0, 0)
-	check(t, e, "e(X, Y)?", 0)
+	if _, err := e.Query("e(X, Y)?"); err == nil {
+		t.Fatal("expected error")
+	}
 
 	e = setup(t, `
 	old(X) :- person(X), age(X, Y), =(Y, 100).
@@ -69,12 +76,475 @@ func TestEquals(t *testing.T) {
 
 func TestEqualsFail(t *testing.T) {
 	e := setup(t, "", 0, 0, 0, 0)
-	err := e.Assert("=(1, 0).")
+	_, err := e.Assert("=(1, 0).")
 	if err == nil {
 		t.Fatal("datalog allowed client to assert 1 = 0.")
 	}
-	err = e.Retract("=(1, 1)~")
+	_, err = e.Retract("=(1, 1)~")
 	if err == nil {
 		t.Fatal("datalog allowed client to retract 1 = 1.")
 	}
 }
+
+func TestNotEquals(t *testing.T) {
+	e := setup(t, `
+	person(alice). person(bob).
+	pair(X, Y) :- person(X), person(Y), !=(X, Y).`, 3, 0, 0, 0)
+	check(t, e, "pair(X, Y)?", 2)
+	check(t, e, "pair(alice, alice)?", 0)
+	check(t, e, "pair(alice, bob)?", 1)
+	check(t, e, "!=(alice, bob)?", 1)
+	check(t, e, "!=(alice, alice)?", 0)
+	check(t, e, "!=(alice, X)?", 0)
+}
+
+func TestInfix(t *testing.T) {
+	// The engine provides Equals and NotEquals without setup.
+	e := dlengine.NewEngine()
+	if _, _, err := e.Batch("test", `
+	person(alice). person(bob). person(carol).
+	age(alice, 100). age(bob, 100). age(carol, 102).
+	old(X) :- person(X), age(X, Y), Y = 100.
+	peer(X, Y) :- age(X, A), age(Y, A), X != Y.
+	z(X) :- X = 0.`); err != nil {
+		t.Fatal(err)
+	}
+	check(t, e, "old(X)?", 2)
+	check(t, e, "peer(X, Y)?", 2)
+	check(t, e, "peer(alice, Y)?", 1)
+	check(t, e, "z(X)?", 1)
+	check(t, e, "alice != bob?", 1)
+	check(t, e, `"alice" = alice?`, 0)
+	check(t, e, "X = alice?", 1)
+	check(t, e, "=(X, alice)?", 1)
+}
+
+func TestCompare(t *testing.T) {
+	e := setup(t, `
+	age(alice, 17). age(bob, 18). age(carol, 40). age(dave, forty).
+	adult(P) :- age(P, A), >=(A, 18).
+	minor(P) :- age(P, A), A < 18.
+	older(P, Q) :- age(P, A), age(Q, B), A > B.
+	same(P, Q) :- age(P, A), age(Q, B), A <= B, B <= A.`, 8, 0, 0, 0)
+	check(t, e, "adult(X)?", 2)
+	check(t, e, "minor(X)?", 1)
+	check(t, e, "older(X, Y)?", 3)
+	check(t, e, "older(alice, Y)?", 0)
+	check(t, e, "same(X, Y)?", 3)
+	check(t, e, "same(dave, dave)?", 0)
+	check(t, e, "<(1, 2)?", 1)
+	check(t, e, "<=(X, 2)?", 0)
+	check(t, e, "2 > 1?", 1)
+	check(t, e, "-2 > -1?", 0)
+}
+
+func TestArithmetic(t *testing.T) {
+	e := setup(t, `
+	price(apple, 100). tax(apple, 7).
+	price(pear, 50). tax(pear, -7).
+	total(X, S) :- price(X, P), tax(X, T), S = P + T.
+	net(X, N) :- price(X, P), tax(X, T), N = P - T.
+	double(X, D) :- total(X, S), D = S * 2.
+	half(X, H) :- total(X, S), H = S / 2.
+	odd(X) :- total(X, S), R = S mod 2, R = 1.
+	nonint(S) :- S = 1 + foo.
+	zero(X, Z) :- price(X, P), Z = P / 0.
+	r(1). r(2). r(a).
+	s(X, Y) :- r(X), Y = X + 1.
+	inc(X, Y) :- Y = X + 1.`, 16, 0, 0, 0)
+	check(t, e, "total(apple, 107)?", 1)
+	check(t, e, "total(pear, X)?", 1)
+	check(t, e, "total(X, 43)?", 1)
+	check(t, e, "net(pear, 57)?", 1)
+	check(t, e, "double(apple, 214)?", 1)
+	check(t, e, "half(X, 21)?", 1)
+	check(t, e, "half(X, 53)?", 1)
+	check(t, e, "odd(X)?", 2)
+	check(t, e, "X = 3 + 4?", 1)
+	check(t, e, "7 = 3 + 4?", 1)
+	check(t, e, "8 = 3 + 4?", 0)
+
+	// Non-integers, zero divisors, and overflow give no facts.
+	check(t, e, "s(X, Y)?", 2)
+	check(t, e, "nonint(S)?", 0)
+	check(t, e, "zero(X, Z)?", 0)
+	check(t, e, "X = 9223372036854775807 + 1?", 0)
+	check(t, e, "X = -9223372036854775808 / -1?", 0)
+
+	// Computed constants are the engine's own, so they can be used in queries
+	// and compared with the constants in the database.
+	a, err := e.Query("total(X, S)")
+	if err != nil || len(a) != 2 {
+		t.Fatalf("unexpected answer: %v, %v", a, err)
+	}
+	for _, fact := range a {
+		if fact.Arg[1] != e.Term[fmt.Sprintf("%v", fact.Arg[1])] {
+			t.Fatalf("computed constant %v is not the engine's", fact.Arg[1])
+		}
+	}
+
+	// Unbound arguments are errors, including those of rules that need the
+	// query to bind them.
+	check(t, e, "inc(1, Y)?", 1)
+	for _, query := range []string{"X = 1 + Y?", "inc(X, Y)?"} {
+		if _, err := e.Query(query); err == nil {
+			t.Fatalf("%s: expected error", query)
+		} else if _, ok := err.(*dlprim.ModeError); !ok {
+			t.Fatalf("%s: expected mode error, got %v", query, err)
+		}
+	}
+	_, err = e.Query("X = 1 + Y?")
+	if msg := "datalog: +(1, _, _): argument 2 must be bound"; err.Error() != msg {
+		t.Fatalf("expected %q, got %q", msg, err)
+	}
+
+	// Rules that never bind the arguments of arithmetic are unsafe.
+	if _, err := e.Assert("unbound(X, S) :- price(X, P), S = P + T."); err == nil {
+		t.Fatal("expected unsafe rule")
+	}
+}
+
+func TestStrings(t *testing.T) {
+	e := dlengine.NewEngine()
+	for _, p := range dlprim.Strings(e) {
+		e.AddPred(p)
+	}
+	_, _, _, errs := e.Process("test", `
+	resource(alice, "/home/alice/notes.txt").
+	resource(bob, "/home/bob/TODO").
+	resource(admin, "/etc/passwd").
+	home(U, R) :- resource(U, R), concat("/home/", U, D), prefix(R, D).
+	file(U, F) :- resource(U, R), concat("/home/", Rest, R), concat(U, F, Rest).
+	text(R) :- resource(U, R), suffix(R, ".txt").
+	secret(R) :- resource(U, R), contains(R, "passwd").
+	short(R) :- resource(U, R), length(R, N), N < 12.
+	plain(R) :- resource(U, R), lower(R, R).
+	user(U) :- resource(U, R), matches(R, "^/home/[a-z]+/").
+	name(U, N) :- resource(U, R), concat(U, "_id", N).
+	unbound(Z) :- concat(X, "a", Z).
+	nonstring(Z) :- concat(1, "a", Z).
+	badregexp(R) :- resource(U, R), matches(R, "[").`)
+	if errs != 0 {
+		t.Fatalf("setup failed with %d errors", errs)
+	}
+	check(t, e, "home(U, R)?", 2)
+	check(t, e, `file(alice, "/notes.txt")?`, 1)
+	check(t, e, "file(U, F)?", 2)
+	check(t, e, "text(R)?", 1)
+	check(t, e, "secret(R)?", 1)
+	check(t, e, "short(R)?", 1)
+	check(t, e, "plain(R)?", 2)
+	check(t, e, "user(U)?", 2)
+	check(t, e, "name(alice, alice_id)?", 1)
+	check(t, e, `name(alice, "alice_id")?`, 1)
+	check(t, e, `concat(X, Y, "ab")?`, 3)
+	check(t, e, `concat("a", Y, ab)?`, 1)
+	check(t, e, `concat(X, X, "aba")?`, 0)
+	if a, err := e.Query(`concat(X, X, "abab")?`); err != nil || len(a) != 1 || a[0].String() != `concat("ab", "ab", "abab")` {
+		t.Fatalf("unexpected answer: %v, %v", a, err)
+	}
+	check(t, e, `lower("ABC", abd)?`, 0)
+	check(t, e, `lower("ABC", "abc")?`, 1)
+	check(t, e, `lower(aBC, abc)?`, 1)
+	check(t, e, `upper(abc, X)?`, 1)
+	check(t, e, `length("héllo", 5)?`, 1)
+
+	// Computed constants are the engine's own.
+	a, err := e.Query("name(U, N)")
+	if err != nil || len(a) != 3 {
+		t.Fatalf("unexpected answer: %v, %v", a, err)
+	}
+	for _, fact := range a {
+		if fact.Arg[1] != e.Term[fmt.Sprintf("%v", fact.Arg[1])] {
+			t.Fatalf("computed constant %v is not the engine's", fact.Arg[1])
+		}
+	}
+
+	// Unbound and non-string arguments, and bad expressions, are errors.
+	for _, query := range []string{"unbound(Z)?", "nonstring(Z)?", "badregexp(R)?", "length(X, 3)?"} {
+		if _, err := e.Query(query); err == nil {
+			t.Fatalf("%s: expected error", query)
+		}
+	}
+}
+
+func TestFunc(t *testing.T) {
+	e := dlengine.NewEngine()
+	calls := 0
+	divmod := func(x, y int64) (int64, int64, error) {
+		calls++
+		if y == 0 {
+			return 0, 0, fmt.Errorf("division by zero")
+		}
+		return x / y, x % y, nil
+	}
+	even := func(x int64) bool { return x%2 == 0 }
+	split := func(path string, yield func(string, int64)) {
+		for i, part := range strings.Split(path, "/") {
+			yield(part, int64(i))
+		}
+	}
+	same := func(c datalog.Const) (datalog.Const, bool) { return c, true }
+	for _, f := range []struct {
+		name, mode string
+		fn         interface{}
+	}{
+		{"divmod", "bbff", divmod},
+		{"even", "b", even},
+		{"split", "bff", split},
+		{"same", "bf", same},
+	} {
+		p, err := dlprim.NewFunc(e, f.name, f.mode, f.fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.AddPred(p)
+	}
+	if _, _, err := e.Batch("test", `
+	n(7). n(8). n(0).
+	halves(X, Q) :- n(X), divmod(X, 2, Q, R).
+	evens(X) :- n(X), even(X).
+	first(P, X) :- split(P, X, 1).
+	bad(Q) :- n(X), divmod(1, X, Q, R).
+	unbound(X, Q) :- divmod(X, 2, Q, R).
+	nonint(Q) :- divmod(x, 2, Q, R).`); err != nil {
+		t.Fatal(err)
+	}
+	check(t, e, "halves(X, Q)?", 3)
+	check(t, e, "halves(7, 3)?", 1)
+	check(t, e, "halves(X, 4)?", 1)
+	check(t, e, "evens(X)?", 2)
+	check(t, e, "divmod(7, 2, 3, 1)?", 1)
+	check(t, e, "divmod(7, 2, 3, 2)?", 0)
+	check(t, e, "divmod(7, 2, Q, Q)?", 0)
+	check(t, e, "divmod(8, 3, Q, Q)?", 1)
+	check(t, e, `split("/home/alice", X, N)?`, 3)
+	check(t, e, `first("/home/alice", home)?`, 1)
+	check(t, e, `first("/home/alice", "home")?`, 1)
+	check(t, e, "same(alice, X)?", 1)
+	check(t, e, "same(alice, alice)?", 1)
+	check(t, e, "same(alice, bob)?", 0)
+
+	// Results are the engine's own constants.
+	a, err := e.Query("halves(X, Q)")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, fact := range a {
+		if fact.Arg[1] != e.Term[fmt.Sprintf("%v", fact.Arg[1])] {
+			t.Fatalf("computed constant %v is not the engine's", fact.Arg[1])
+		}
+	}
+
+	// The function is called once for each search.
+	calls = 0
+	check(t, e, "divmod(7, 2, Q, R)?", 1)
+	if calls != 1 {
+		t.Fatalf("expected 1 call, got %d", calls)
+	}
+
+	// Errors returned by the function, and unbound or mistyped arguments, are
+	// errors.
+	check(t, e, "unbound(7, Q)?", 1)
+	for _, query := range []string{"bad(Q)?", "divmod(X, 2, Q, R)?", "unbound(X, Q)?", "nonint(Q)?"} {
+		if _, err := e.Query(query); err == nil {
+			t.Fatalf("%s: expected error", query)
+		}
+	}
+
+	// Functions that don't match the mode are rejected.
+	for _, f := range []struct {
+		mode string
+		fn   interface{}
+	}{
+		{"bbff", even},
+		{"bx", even},
+		{"bf", split},
+		{"bf", func(x float64) int64 { return 0 }},
+		{"bf", func(x int64) (int64, error, bool) { return 0, nil, true }},
+		{"bf", 7},
+	} {
+		if _, err := dlprim.NewFunc(nil, "f", f.mode, f.fn); err == nil {
+			t.Fatalf("%s: expected error for %T", f.mode, f.fn)
+		}
+	}
+}
+
+func TestTable(t *testing.T) {
+	type grant struct {
+		User     string `datalog:"1,ident"`
+		Resource string `datalog:"2"`
+		Level    int    `datalog:"3"`
+		Note     string
+	}
+	type file struct {
+		Path string
+		Size uint32
+		note string
+	}
+	type pair struct {
+		A, B string
+	}
+	grants := []grant{
+		{"alice", "/home/alice", 2, "owner"},
+		{"alice", "/tmp", 1, ""},
+		{"bob", "/home/bob", 2, "owner"},
+	}
+	files := []*file{{"/home/alice", 10, ""}, nil, {"/tmp", 0, ""}}
+	roles := map[string]string{"alice": "admin", "bob": "user"}
+	quotas := map[int64]file{1: {"/home/alice", 100, ""}}
+	pairs := []pair{{"a", "b"}, {"c", "c"}}
+
+	e := dlengine.NewEngine()
+	for name, data := range map[string]interface{}{
+		"grant": grants, "file": &files, "role": roles, "quota": quotas, "path": []string{"/tmp"},
+		"pair": pairs,
+	} {
+		p, err := dlprim.NewTable(e, name, data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		e.AddPred(p)
+	}
+	if _, _, err := e.Batch("test", `
+	person(alice). person(bob).
+	owner(U, R) :- person(U), grant(U, R, 2).
+	big(R) :- grant(U, R, L), file(R, S), S > 5.`); err != nil {
+		t.Fatal(err)
+	}
+	check(t, e, "grant(U, R, L)?", 3)
+	check(t, e, "owner(U, R)?", 2)
+	check(t, e, `grant("alice", "/tmp", 1)?`, 1)
+	check(t, e, "grant(carol, R, L)?", 0)
+	check(t, e, "grant(alice, R, 3)?", 0)
+	check(t, e, "file(P, S)?", 2)
+	check(t, e, "big(R)?", 1)
+	check(t, e, "role(U, R)?", 2)
+	check(t, e, `role(alice, "admin")?`, 1)
+	check(t, e, "role(carol, R)?", 0)
+	check(t, e, "role(7, R)?", 0)
+	check(t, e, "quota(1, P, S)?", 1)
+	check(t, e, "quota(K, P, 100)?", 1)
+	check(t, e, "quota(alice, P, S)?", 0)
+	check(t, e, `path("/tmp")?`, 1)
+	check(t, e, "pair(X, Y)?", 2)
+	if a, err := e.Query("pair(X, X)?"); err != nil || len(a) != 1 || a[0].String() != `pair("c", "c")` {
+		t.Fatalf("unexpected answer: %v, %v", a, err)
+	}
+
+	// Changes through a pointer are seen by later queries.
+	files = append(files, &file{"/home/bob", 20, ""})
+	check(t, e, "big(R)?", 2)
+
+	// Tables are read-only.
+	if _, err := e.Assert(`role(carol, "user").`); err == nil {
+		t.Fatal("expected error")
+	}
+
+	for _, data := range []interface{}{
+		nil, 7, []bool{true}, map[bool]string{}, []struct{}{},
+		[]struct {
+			A string `datalog:"2"`
+		}{},
+		[]struct {
+			A string `datalog:"1"`
+			B string `datalog:"1"`
+		}{},
+		[]struct {
+			A string `datalog:"1,quoted"`
+		}{},
+		[]struct {
+			A bool `datalog:"1"`
+		}{},
+	} {
+		if _, err := dlprim.NewTable(nil, "t", data); err == nil {
+			t.Fatalf("expected error for %T", data)
+		}
+	}
+}
+
+func TestFactoryPred(t *testing.T) {
+	// Each engine supplies its own constants to the same custom predicates.
+	length, err := dlprim.NewFunc(nil, "len", "bf", func(s string) int64 { return int64(len(s)) })
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		e := dlengine.NewEngine()
+		e.AddPred(dlprim.Concat)
+		e.AddPred(length)
+		if e.Pred["concat/3"] == dlprim.Concat || e.Pred["len/2"] == length {
+			t.Fatal("expected engine's own instances")
+		}
+		for _, query := range []string{"concat(a, b, X)?", "X = 1 + 2?", `len("abc", X)?`} {
+			a, err := e.Query(query)
+			if err != nil || len(a) != 1 {
+				t.Fatalf("unexpected answer: %v, %v", a, err)
+			}
+			for _, arg := range a[0].Arg {
+				if arg != e.Term[fmt.Sprintf("%v", arg)] {
+					t.Fatalf("%s: constant %v is not the engine's", query, arg)
+				}
+			}
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	// Primitives are delayed until later literals bind their arguments.
+	e := setup(t, `
+	age(alice, 17). age(bob, 18).
+	price(apple, 100). tax(apple, 7).
+	person(alice).
+	adult(P) :- A >= 18, age(P, A).
+	total(X, S) :- S = P + T, price(X, P), tax(X, T).
+	alias(X, Y) :- X = Y, person(X).
+	never(X, S) :- S = X + 1, S > 0.`, 9, 0, 0, 0)
+	check(t, e, "adult(X)?", 1)
+	check(t, e, "total(apple, 107)?", 1)
+	check(t, e, "alias(X, Y)?", 1)
+	check(t, e, "alias(X, alice)?", 1)
+
+	e.AddPred(dlprim.Concat)
+	if _, err := e.Assert(`home(U, D) :- concat("/home/", U, D), age(U, A).`); err != nil {
+		t.Fatal(err)
+	}
+	check(t, e, "home(U, D)?", 2)
+
+	// A rule that never binds the arguments of a primitive fails.
+	_, err := e.Query("never(X, S)?")
+	if _, ok := err.(*dlprim.ModeError); !ok {
+		t.Fatalf("expected mode error, got %v", err)
+	}
+}
+
+// weekday is a user-defined predicate built on ReadOnly.
+type weekday struct {
+	dlprim.ReadOnly
+}
+
+func (p *weekday) String() string {
+	return "weekday"
+}
+
+func (p *weekday) Search(target *datalog.Literal, discovered func(c *datalog.Clause)) {
+	switch fmt.Sprintf("%v", target.Arg[0]) {
+	case "monday", "tuesday", "wednesday", "thursday", "friday":
+		discovered(datalog.NewClause(target))
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	p := new(weekday)
+	p.SetArity(1)
+	e := setup(t, "", 0, 0, 0, 0)
+	e.AddPred(p)
+	check(t, e, "weekday(monday)?", 1)
+	check(t, e, "weekday(sunday)?", 0)
+	if _, err := e.Assert("weekday(sunday)."); err == nil {
+		t.Fatal("assert for read-only predicate succeeded")
+	}
+	if _, err := e.Retract("weekday(monday)~"); err == nil {
+		t.Fatal("retract for read-only predicate succeeded")
+	}
+}
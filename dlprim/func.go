@@ -0,0 +1,312 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlprim
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+
+	"github.com/kevinawalsh/datalog"
+)
+
+var (
+	int64Type  = reflect.TypeOf(int64(0))
+	stringType = reflect.TypeOf("")
+	boolType   = reflect.TypeOf(false)
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+	constType  = reflect.TypeOf((*datalog.Const)(nil)).Elem()
+)
+
+// NewFunc returns a custom predicate that calls the Go function fn to search
+// for facts. The mode has one character for each argument of the predicate: 'b'
+// for an argument that must be bound, which is passed to fn, and 'f' for an
+// argument that fn produces. For example, given
+//   func divmod(x, y int64) (q, r int64, err error)
+// NewFunc(f, "divmod", "bbff", divmod) returns a predicate for which
+// divmod(7, 2, Q, R) generates fact divmod(7, 2, 3, 1).
+//
+// The function takes one parameter for each 'b' argument, in order, of type
+// int64 (for Integer constants), string (for StringConst constants), or
+// datalog.Const (for any constant). It returns one result for each 'f' argument,
+// in order, of type int64, string, or datalog.Const, optionally followed by a
+// bool, which is false if there is no fact, and by an error. Alternatively, to
+// generate any number of facts, the function takes one more parameter, a
+// function with one parameter for each 'f' argument, which it calls once for
+// each fact, and returns only an optional error.
+//
+// If an 'f' argument is bound, facts are generated only if the produced value
+// is the same, comparing integers and strings by value. String results are
+// Quoted strings, and integer results are Integer constants, created using f.
+// If f is nil, new constants are created for each result, unless replaced
+// using WithFactory.
+//
+// In the body of a rule, a literal is delayed until its 'b' arguments are bound
+// (see datalog.Moded). If a 'b' argument is unbound or has the wrong type, or
+// if fn returns an error, the search fails with an error.
+func NewFunc(f ConstFactory, name, mode string, fn interface{}) (datalog.Pred, error) {
+	if f == nil {
+		f = defaultFactory{}
+	}
+	p := &funcPrim{name: name, mode: mode, factory: f, fn: reflect.ValueOf(fn)}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("datalog: %s: %v", name, err)
+	}
+	p.SetArity(len(mode))
+	return p, nil
+}
+
+type funcPrim struct {
+	ReadOnly
+	name    string
+	mode    string
+	factory ConstFactory
+	fn      reflect.Value
+	nin     int  // number of 'b' arguments
+	nout    int  // number of 'f' arguments
+	gen     bool // whether fn takes a function to call for each fact
+	hasBool bool // whether fn returns a bool after its results
+	hasErr  bool // whether fn returns an error last
+}
+
+func valueType(t reflect.Type) bool {
+	return t == int64Type || t == stringType || t == constType
+}
+
+// validate checks the mode and the signature of fn.
+func (p *funcPrim) validate() error {
+	for _, m := range p.mode {
+		switch m {
+		case 'b':
+			p.nin++
+		case 'f':
+			p.nout++
+		default:
+			return fmt.Errorf("bad mode %q", p.mode)
+		}
+	}
+	if p.fn.Kind() != reflect.Func {
+		return errors.New("not a function")
+	}
+	t := p.fn.Type()
+	if t.IsVariadic() {
+		return errors.New("variadic function")
+	}
+	p.gen = t.NumIn() == p.nin+1 && t.In(p.nin).Kind() == reflect.Func
+	if t.NumIn() != p.nin && !p.gen {
+		return fmt.Errorf("function takes %d parameters, mode %q needs %d", t.NumIn(), p.mode, p.nin)
+	}
+	for i := 0; i < p.nin; i++ {
+		if !valueType(t.In(i)) {
+			return fmt.Errorf("bad parameter type %v", t.In(i))
+		}
+	}
+	nout := p.nout
+	if p.gen {
+		yield := t.In(p.nin)
+		if yield.NumIn() != p.nout || yield.NumOut() != 0 || yield.IsVariadic() {
+			return fmt.Errorf("generator function %v doesn't match mode %q", yield, p.mode)
+		}
+		for i := 0; i < p.nout; i++ {
+			if !valueType(yield.In(i)) {
+				return fmt.Errorf("bad generator parameter type %v", yield.In(i))
+			}
+		}
+		nout = 0
+	}
+	n := t.NumOut()
+	if n > nout && t.Out(n-1) == errorType {
+		p.hasErr = true
+		n--
+	}
+	if !p.gen && n > nout && t.Out(n-1) == boolType {
+		p.hasBool = true
+		n--
+	}
+	if n != nout {
+		return fmt.Errorf("function returns %d results, mode %q needs %d", n, p.mode, nout)
+	}
+	for i := 0; i < nout; i++ {
+		if !valueType(t.Out(i)) {
+			return fmt.Errorf("bad result type %v", t.Out(i))
+		}
+	}
+	return nil
+}
+
+func (p *funcPrim) String() string {
+	return p.name
+}
+
+func (p *funcPrim) WithFactory(f ConstFactory) datalog.Pred {
+	q := *p
+	q.factory = f
+	return &q
+}
+
+// input converts argument i of target to a parameter of type t.
+func (p *funcPrim) input(target *datalog.Literal, i int, t reflect.Type) (reflect.Value, error) {
+	arg := target.Arg[i]
+	if arg.Variable() {
+		return reflect.Value{}, &ModeError{target, fmt.Sprintf("argument %d must be bound", i+1)}
+	}
+	switch t {
+	case int64Type:
+		if c, ok := arg.(Integer); ok {
+			return reflect.ValueOf(c.Int64()), nil
+		}
+		return reflect.Value{}, &ModeError{target, fmt.Sprintf("argument %d must be an integer", i+1)}
+	case stringType:
+		if c, ok := arg.(StringConst); ok {
+			return reflect.ValueOf(c.StringValue()), nil
+		}
+		return reflect.Value{}, &ModeError{target, fmt.Sprintf("argument %d must be a string", i+1)}
+	default:
+		v := reflect.New(constType).Elem()
+		v.Set(reflect.ValueOf(arg))
+		return v, nil
+	}
+}
+
+// inputs converts the 'b' arguments of target to parameters of fn.
+func (p *funcPrim) inputs(target *datalog.Literal) ([]reflect.Value, error) {
+	t := p.fn.Type()
+	in := make([]reflect.Value, 0, t.NumIn())
+	for i, m := range p.mode {
+		if m == 'b' {
+			v, err := p.input(target, i, t.In(len(in)))
+			if err != nil {
+				return nil, err
+			}
+			in = append(in, v)
+		}
+	}
+	return in, nil
+}
+
+// call calls fn with parameters in for target and returns the results for
+// each fact.
+func (p *funcPrim) call(target *datalog.Literal, in []reflect.Value) ([][]reflect.Value, error) {
+	var facts [][]reflect.Value
+	if p.gen {
+		yield := reflect.MakeFunc(p.fn.Type().In(p.nin), func(args []reflect.Value) []reflect.Value {
+			facts = append(facts, append([]reflect.Value(nil), args...))
+			return nil
+		})
+		in = append(in, yield)
+	}
+	out := p.fn.Call(in)
+	if p.hasErr {
+		if err := out[len(out)-1]; !err.IsNil() {
+			return nil, fmt.Errorf("datalog: %s: %v", pattern(target), err.Interface())
+		}
+	}
+	if !p.gen && (!p.hasBool || out[p.nout].Bool()) {
+		facts = append(facts, out[:p.nout])
+	}
+	return facts, nil
+}
+
+func (p *funcPrim) Modes() []datalog.Mode {
+	return []datalog.Mode{newMode(p.mode, 1)}
+}
+
+// Check returns an error unless the 'b' arguments of target are bound to
+// constants of the required type.
+func (p *funcPrim) Check(target *datalog.Literal) error {
+	_, err := p.inputs(target)
+	return err
+}
+
+func (p *funcPrim) Search(target *datalog.Literal, discovered func(c *datalog.Clause)) {
+	p.SearchErr(target, discovered)
+}
+
+// SearchErr calls fn once for target and returns any error it returns.
+func (p *funcPrim) SearchErr(target *datalog.Literal, discovered func(c *datalog.Clause)) error {
+	in, err := p.inputs(target)
+	if err != nil {
+		return err
+	}
+	facts, err := p.call(target, in)
+	if err != nil {
+		return err
+	}
+next:
+	for _, results := range facts {
+		args := make([]datalog.Term, len(p.mode))
+		j := 0
+		for i, m := range p.mode {
+			args[i] = target.Arg[i]
+			if m == 'b' {
+				continue
+			}
+			v := results[j]
+			j++
+			if !args[i].Variable() {
+				if !same(args[i], v) {
+					continue next
+				}
+			} else if args[i] = toConst(p.factory, v, false); args[i] == nil {
+				continue next
+			}
+		}
+		if consistent(target, args) {
+			discovered(datalog.NewClause(datalog.NewLiteral(p, args...)))
+		}
+	}
+	return nil
+}
+
+// toConst converts v, which has an integer, string, or datalog.Const type, to a
+// constant created using f. Strings become identifiers if ident is set and they
+// are valid identifiers. It returns nil for a nil constant or an unsigned
+// integer too large for an Integer.
+func toConst(f ConstFactory, v reflect.Value, ident bool) datalog.Const {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return f.NewInteger(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if v.Uint() > math.MaxInt64 {
+			return nil
+		}
+		return f.NewInteger(int64(v.Uint()))
+	case reflect.String:
+		return f.NewString(v.String(), ident)
+	default:
+		c, _ := v.Interface().(datalog.Const)
+		return c
+	}
+}
+
+// same checks whether t is the same as v, which has an integer, string, or
+// datalog.Const type, comparing integers and strings by value.
+func same(t datalog.Term, v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		c, ok := t.(Integer)
+		return ok && c.Int64() == v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		c, ok := t.(Integer)
+		return ok && c.Int64() >= 0 && uint64(c.Int64()) == v.Uint()
+	case reflect.String:
+		c, ok := t.(StringConst)
+		return ok && c.StringValue() == v.String()
+	default:
+		c, _ := v.Interface().(datalog.Const)
+		return c != nil && t == datalog.Term(c)
+	}
+}
@@ -0,0 +1,353 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlprim
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/kevinawalsh/datalog"
+)
+
+// StringConst is a constant with a string value. The dlengine.Quoted and
+// dlengine.Ident types are StringConst constants, so the string primitives
+// work on quoted strings like "/home/alice" and identifiers like alice alike.
+// They compare bound arguments by value, so concat(a, b, "ab") holds. In the
+// body of a rule, a literal is delayed until the arguments they require are
+// bound (see datalog.Moded).
+type StringConst interface {
+	datalog.Const
+	StringValue() string // the value, without quotes
+	IsIdent() bool       // whether the constant is an identifier
+}
+
+// Concat is a custom predicate for string concatenation, defined by these
+// rules:
+//   concat(c1, c2, Z) generates fact concat(c1, c2, c3), where c3 = c1 + c2.
+//   concat(c1, Y, c3) generates fact concat(c1, c2, c3) if c3 = c1 + c2.
+//   concat(X, c2, c3) generates fact concat(c1, c2, c3) if c3 = c1 + c2.
+//   concat(X, Y, c3) generates fact concat(c1, c2, c3) for each way of
+//   splitting c3 into c1 + c2.
+// All constants must be StringConst constants. Otherwise, or if neither c3 nor
+// both c1 and c2 are bound, the search fails with an error. A computed result
+// is an identifier if the value is a valid identifier and the constants it was
+// computed from are identifiers, and a quoted string otherwise.
+var Concat datalog.Pred
+
+// Prefix is a custom predicate for prefix tests. Fact prefix(c1, c2) holds if
+// c2 is a prefix of c1. Both arguments must be bound to StringConst constants.
+var Prefix datalog.Pred
+
+// Suffix is a custom predicate for suffix tests. Fact suffix(c1, c2) holds if
+// c2 is a suffix of c1. See Prefix.
+var Suffix datalog.Pred
+
+// Contains is a custom predicate for substring tests. Fact contains(c1, c2)
+// holds if c2 is a substring of c1. See Prefix.
+var Contains datalog.Pred
+
+// Length is a custom predicate for string length, in runes, defined by these
+// rules:
+//   length(c1, N) generates fact length(c1, c2), where c2 is the length of c1.
+//   length(c1, c2) generates fact length(c1, c2) if c2 is the length of c1.
+// The constant c1 must be a StringConst constant, otherwise the search fails
+// with an error.
+var Length datalog.Pred
+
+// Lower is a custom predicate for lower casing, defined by these rules:
+//   lower(c1, Y) generates fact lower(c1, c2), where c2 is c1 in lower case.
+//   lower(c1, c2) generates fact lower(c1, c2) if c2 is c1 in lower case.
+// The constant c1 must be a StringConst constant, otherwise the search fails
+// with an error. See Concat for the kind of constant computed.
+var Lower datalog.Pred
+
+// Upper is a custom predicate for upper casing, written upper(X, Y). See Lower.
+var Upper datalog.Pred
+
+// Matches is a custom predicate for regular expression matching. Fact
+// matches(c1, c2) holds if c1 contains a match of the regular expression c2,
+// in the syntax of Go's regexp package. Use ^ and $ to match all of c1. Both
+// arguments must be bound to StringConst constants, and c2 must be a valid
+// regular expression, otherwise the search fails with an error. Each instance
+// compiles a given expression only once.
+var Matches datalog.Pred
+
+func init() {
+	preds := Strings(defaultFactory{})
+	Concat, Prefix, Suffix, Contains = preds[0], preds[1], preds[2], preds[3]
+	Length, Lower, Upper, Matches = preds[4], preds[5], preds[6], preds[7]
+}
+
+// Strings returns new instances of Concat, Prefix, Suffix, Contains, Length,
+// Lower, Upper, and Matches, in that order, that use f to create the constants
+// they discover. The instances in package variables, like Concat, create new
+// constants for each result, unless replaced using WithFactory.
+func Strings(f ConstFactory) []datalog.Pred {
+	return []datalog.Pred{
+		newStrPrim("concat", 3, f, checkConcat, searchConcat, newMode("bbf", primCost), newMode("ffb", 1)),
+		newStrPrim("prefix", 2, f, checkBound, test(strings.HasPrefix), newMode("bb", primCost)),
+		newStrPrim("suffix", 2, f, checkBound, test(strings.HasSuffix), newMode("bb", primCost)),
+		newStrPrim("contains", 2, f, checkBound, test(strings.Contains), newMode("bb", primCost)),
+		newLengthPrim(f),
+		newStrPrim("lower", 2, f, checkInput, convert(strings.ToLower), newMode("bf", primCost)),
+		newStrPrim("upper", 2, f, checkInput, convert(strings.ToUpper), newMode("bf", primCost)),
+		newMatchPrim(f),
+	}
+}
+
+func (defaultFactory) NewString(v string, ident bool) StringConst {
+	return &strConst{v: v, ident: ident}
+}
+
+// strConst is a string constant created by defaultFactory.
+type strConst struct {
+	v     string
+	ident bool
+	datalog.DistinctConst
+}
+
+func (c *strConst) String() string {
+	if c.ident {
+		return c.v
+	}
+	return strconv.Quote(c.v)
+}
+
+func (c *strConst) StringValue() string {
+	return c.v
+}
+
+func (c *strConst) IsIdent() bool {
+	return c.ident
+}
+
+type strPrim struct {
+	ReadOnly
+	name    string
+	nstr    int // number of leading arguments that are strings
+	factory ConstFactory
+	check   func(target *datalog.Literal, s []StringConst) error
+	search  func(p *strPrim, target *datalog.Literal, s []StringConst, discovered func(c *datalog.Clause))
+	modes   []datalog.Mode
+}
+
+func newStrPrim(name string, arity int, f ConstFactory,
+	check func(target *datalog.Literal, s []StringConst) error,
+	search func(p *strPrim, target *datalog.Literal, s []StringConst, discovered func(c *datalog.Clause)),
+	modes ...datalog.Mode) *strPrim {
+	p := &strPrim{name: name, nstr: arity, factory: f, check: check, search: search, modes: modes}
+	p.SetArity(arity)
+	return p
+}
+
+func (p *strPrim) String() string {
+	return p.name
+}
+
+func (p *strPrim) WithFactory(f ConstFactory) datalog.Pred {
+	q := *p
+	q.factory = f
+	return &q
+}
+
+// args returns the arguments of target that are bound to StringConst
+// constants, with nil for variables. Only the first n arguments are examined.
+func args(target *datalog.Literal, n int) ([]StringConst, error) {
+	s := make([]StringConst, n)
+	for i := range s {
+		switch t := target.Arg[i].(type) {
+		case StringConst:
+			s[i] = t
+		default:
+			if !t.Variable() {
+				return nil, &ModeError{target, fmt.Sprintf("argument %d must be a string", i+1)}
+			}
+		}
+	}
+	return s, nil
+}
+
+// Check returns an error unless the arguments of target are bound to
+// StringConst constants as required.
+func (p *strPrim) Check(target *datalog.Literal) error {
+	s, err := args(target, p.nstr)
+	if err != nil {
+		return err
+	}
+	return p.check(target, s)
+}
+
+func (p *strPrim) Modes() []datalog.Mode {
+	return p.modes
+}
+
+func (p *strPrim) Search(target *datalog.Literal, discovered func(c *datalog.Clause)) {
+	s, err := args(target, p.nstr)
+	if err != nil || p.check(target, s) != nil {
+		return
+	}
+	p.search(p, target, s, discovered)
+}
+
+func checkConcat(target *datalog.Literal, s []StringConst) error {
+	if s[2] == nil && (s[0] == nil || s[1] == nil) {
+		return &ModeError{target, "arguments 1 and 2, or argument 3, must be bound"}
+	}
+	return nil
+}
+
+func searchConcat(p *strPrim, target *datalog.Literal, s []StringConst, discovered func(c *datalog.Clause)) {
+	if s[0] != nil && s[1] != nil {
+		v := s[0].StringValue() + s[1].StringValue()
+		if s[2] == nil {
+			result := p.factory.NewString(v, s[0].IsIdent() && s[1].IsIdent())
+			discovered(datalog.NewClause(datalog.NewLiteral(p, s[0], s[1], result)))
+		} else if s[2].StringValue() == v {
+			discovered(datalog.NewClause(target))
+		}
+		return
+	}
+	v := s[2].StringValue()
+	ident := s[2].IsIdent()
+	for i := 0; i <= len(v); {
+		x, y := s[0], s[1]
+		if (x == nil || x.StringValue() == v[:i]) && (y == nil || y.StringValue() == v[i:]) {
+			if x == nil {
+				x = p.factory.NewString(v[:i], ident)
+			}
+			if y == nil {
+				y = p.factory.NewString(v[i:], ident)
+			}
+			if args := []datalog.Term{x, y, s[2]}; consistent(target, args) {
+				discovered(datalog.NewClause(datalog.NewLiteral(p, args...)))
+			}
+		}
+		if i == len(v) {
+			break
+		}
+		_, n := utf8.DecodeRuneInString(v[i:])
+		i += n
+	}
+}
+
+func checkBound(target *datalog.Literal, s []StringConst) error {
+	for i := range s {
+		if s[i] == nil {
+			return &ModeError{target, fmt.Sprintf("argument %d must be bound", i+1)}
+		}
+	}
+	return nil
+}
+
+func checkInput(target *datalog.Literal, s []StringConst) error {
+	return checkBound(target, s[:1])
+}
+
+// test returns a search function for a primitive that holds when f does.
+func test(f func(s, t string) bool) func(*strPrim, *datalog.Literal, []StringConst, func(*datalog.Clause)) {
+	return func(p *strPrim, target *datalog.Literal, s []StringConst, discovered func(c *datalog.Clause)) {
+		if f(s[0].StringValue(), s[1].StringValue()) {
+			discovered(datalog.NewClause(target))
+		}
+	}
+}
+
+// convert returns a search function for a primitive that relates each string to
+// f of that string.
+func convert(f func(s string) string) func(*strPrim, *datalog.Literal, []StringConst, func(*datalog.Clause)) {
+	return func(p *strPrim, target *datalog.Literal, s []StringConst, discovered func(c *datalog.Clause)) {
+		v := f(s[0].StringValue())
+		if s[1] == nil {
+			result := p.factory.NewString(v, s[0].IsIdent())
+			discovered(datalog.NewClause(datalog.NewLiteral(p, s[0], result)))
+		} else if s[1].StringValue() == v {
+			discovered(datalog.NewClause(target))
+		}
+	}
+}
+
+func newLengthPrim(f ConstFactory) *strPrim {
+	p := newStrPrim("length", 2, f, checkBound, searchLength, newMode("bf", primCost))
+	p.nstr = 1
+	return p
+}
+
+func searchLength(p *strPrim, target *datalog.Literal, s []StringConst, discovered func(c *datalog.Clause)) {
+	n := int64(utf8.RuneCountInString(s[0].StringValue()))
+	switch t := target.Arg[1].(type) {
+	case Integer:
+		if t.Int64() == n {
+			discovered(datalog.NewClause(target))
+		}
+	default:
+		if t.Variable() {
+			result := p.factory.NewInteger(n)
+			discovered(datalog.NewClause(datalog.NewLiteral(p, s[0], result)))
+		}
+	}
+}
+
+// matchPrim is a strPrim that caches compiled regular expressions.
+type matchPrim struct {
+	strPrim
+	mu    sync.Mutex
+	cache map[string]*regexp.Regexp
+}
+
+func newMatchPrim(f ConstFactory) *matchPrim {
+	p := &matchPrim{cache: make(map[string]*regexp.Regexp)}
+	p.strPrim = *newStrPrim("matches", 2, f, p.checkMatch, p.searchMatch, newMode("bb", primCost))
+	return p
+}
+
+func (p *matchPrim) WithFactory(f ConstFactory) datalog.Pred {
+	return newMatchPrim(f)
+}
+
+// compile returns the compiled form of expr.
+func (p *matchPrim) compile(expr string) (*regexp.Regexp, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if re, ok := p.cache[expr]; ok {
+		return re, nil
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, err
+	}
+	p.cache[expr] = re
+	return re, nil
+}
+
+func (p *matchPrim) checkMatch(target *datalog.Literal, s []StringConst) error {
+	if err := checkBound(target, s); err != nil {
+		return err
+	}
+	if _, err := p.compile(s[1].StringValue()); err != nil {
+		return fmt.Errorf("datalog: %s: %v", pattern(target), err)
+	}
+	return nil
+}
+
+func (p *matchPrim) searchMatch(_ *strPrim, target *datalog.Literal, s []StringConst, discovered func(c *datalog.Clause)) {
+	re, err := p.compile(s[1].StringValue())
+	if err == nil && re.MatchString(s[0].StringValue()) {
+		discovered(datalog.NewClause(target))
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package dlprim
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/kevinawalsh/datalog"
+)
+
+// NewTable returns a read-only custom predicate whose facts are the elements of
+// data, which must be a slice, a pointer to a slice, or a map. Elements can be
+// structs, pointers to structs, or single values of integer, string, or
+// datalog.Const type. For maps, the key is the first argument of each fact and
+// the value supplies the rest.
+//
+// A struct supplies one argument for each field with a datalog tag, which gives
+// the argument position, counting from 1 (or from 2 for map values), and may
+// add ",ident" to produce identifiers rather than quoted strings, e.g.:
+//   type Grant struct {
+//   	User     string `datalog:"1,ident"`
+//   	Resource string `datalog:"2"`
+//   	Expires  int64  `datalog:"3"`
+//   	Note     string // not an argument
+//   }
+// If a struct has no datalog tags, each of its exported fields supplies one
+// argument, in order. Fields must have integer, string, or datalog.Const type.
+//
+// Bound arguments select the facts with the same values, comparing integers
+// and strings by value, and a bound map key is looked up directly. Values for
+// unbound arguments are created using f, or, if f is nil, new constants are
+// created for each value, unless replaced using WithFactory. Since data is read
+// for each search, changes to a map, or to a slice through a pointer, affect
+// later queries. Changes must not be concurrent with queries.
+func NewTable(f ConstFactory, name string, data interface{}) (datalog.Pred, error) {
+	if f == nil {
+		f = defaultFactory{}
+	}
+	p := &tablePrim{name: name, factory: f, data: reflect.ValueOf(data)}
+	if err := p.validate(); err != nil {
+		return nil, fmt.Errorf("datalog: %s: %v", name, err)
+	}
+	return p, nil
+}
+
+// column describes how to get one argument from an element.
+type column struct {
+	field int  // index of the struct field, or -1 for the element itself
+	ident bool // whether strings are identifiers
+}
+
+type tablePrim struct {
+	ReadOnly
+	name    string
+	factory ConstFactory
+	data    reflect.Value
+	key     reflect.Type // type of map keys, or nil for slices
+	cols    []column     // columns of each element or map value
+}
+
+// validType checks whether values of type t can be arguments.
+func validType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.String:
+		return true
+	}
+	return t == constType
+}
+
+// validate checks the type of data and finds its columns.
+func (p *tablePrim) validate() error {
+	if !p.data.IsValid() {
+		return errors.New("no data")
+	}
+	t := p.data.Type()
+	if t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Slice {
+		t = t.Elem()
+	}
+	var elem reflect.Type
+	switch t.Kind() {
+	case reflect.Slice:
+		elem = t.Elem()
+	case reflect.Map:
+		if !validType(t.Key()) {
+			return fmt.Errorf("bad key type %v", t.Key())
+		}
+		p.key = t.Key()
+		elem = t.Elem()
+	default:
+		return fmt.Errorf("data must be a slice or map, not %v", t)
+	}
+	if elem.Kind() == reflect.Ptr && elem.Elem().Kind() == reflect.Struct {
+		elem = elem.Elem()
+	}
+	if elem.Kind() != reflect.Struct {
+		if !validType(elem) {
+			return fmt.Errorf("bad element type %v", elem)
+		}
+		p.cols = []column{{field: -1}}
+	} else if err := p.fields(elem); err != nil {
+		return err
+	}
+	arity := len(p.cols)
+	if p.key != nil {
+		arity++
+	}
+	p.SetArity(arity)
+	return nil
+}
+
+// fields finds the columns of struct type t.
+func (p *tablePrim) fields(t reflect.Type) error {
+	first := 1
+	if p.key != nil {
+		first = 2
+	}
+	var cols []column
+	tagged := false
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag, ok := f.Tag.Lookup("datalog")
+		if !ok || tag == "-" {
+			continue
+		}
+		tagged = true
+		opts := strings.Split(tag, ",")
+		n, err := strconv.Atoi(opts[0])
+		if err != nil || n < first {
+			return fmt.Errorf("bad tag %q for field %s", tag, f.Name)
+		}
+		c := column{field: i}
+		for _, opt := range opts[1:] {
+			if opt != "ident" {
+				return fmt.Errorf("bad tag %q for field %s", tag, f.Name)
+			}
+			c.ident = true
+		}
+		for len(cols) <= n-first {
+			cols = append(cols, column{field: -1})
+		}
+		if cols[n-first].field >= 0 {
+			return fmt.Errorf("duplicate tag %q for field %s", tag, f.Name)
+		}
+		cols[n-first] = c
+	}
+	if !tagged {
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" && f.Tag.Get("datalog") != "-" {
+				cols = append(cols, column{field: i})
+			}
+		}
+	}
+	if len(cols) == 0 {
+		return fmt.Errorf("no fields in %v", t)
+	}
+	for i, c := range cols {
+		if c.field < 0 {
+			return fmt.Errorf("no field for argument %d", i+first)
+		}
+		if f := t.Field(c.field); f.PkgPath != "" || !validType(f.Type) {
+			return fmt.Errorf("bad field %s", f.Name)
+		}
+	}
+	p.cols = cols
+	return nil
+}
+
+func (p *tablePrim) String() string {
+	return p.name
+}
+
+func (p *tablePrim) WithFactory(f ConstFactory) datalog.Pred {
+	q := *p
+	q.factory = f
+	return &q
+}
+
+// Modes reports that a search of a map with a bound key is cheap.
+func (p *tablePrim) Modes() []datalog.Mode {
+	free := strings.Repeat("f", p.Arity())
+	if p.key == nil {
+		return []datalog.Mode{newMode(free, 1)}
+	}
+	return []datalog.Mode{newMode("b"+free[1:], primCost), newMode(free, 1)}
+}
+
+func (p *tablePrim) Search(target *datalog.Literal, discovered func(c *datalog.Clause)) {
+	data := p.data
+	if data.Kind() == reflect.Ptr {
+		if data.IsNil() {
+			return
+		}
+		data = data.Elem()
+	}
+	if data.Kind() == reflect.Slice {
+		for i := 0; i < data.Len(); i++ {
+			p.search(target, nil, data.Index(i), discovered)
+		}
+		return
+	}
+	if !target.Arg[0].Variable() {
+		if k, ok := keyValue(target.Arg[0], p.key); ok {
+			if v := data.MapIndex(k); v.IsValid() {
+				p.search(target, []reflect.Value{k}, v, discovered)
+			}
+		}
+		return
+	}
+	for _, k := range data.MapKeys() {
+		p.search(target, []reflect.Value{k}, data.MapIndex(k), discovered)
+	}
+}
+
+// search generates the fact for the given map key, if any, and element, if it
+// matches target.
+func (p *tablePrim) search(target *datalog.Literal, key []reflect.Value, elem reflect.Value, discovered func(c *datalog.Clause)) {
+	if elem.Kind() == reflect.Ptr && p.cols[0].field >= 0 {
+		if elem.IsNil() {
+			return
+		}
+		elem = elem.Elem()
+	}
+	values := key
+	idents := make([]bool, len(key), len(key)+len(p.cols))
+	for _, c := range p.cols {
+		if c.field < 0 {
+			values = append(values, elem)
+		} else {
+			values = append(values, elem.Field(c.field))
+		}
+		idents = append(idents, c.ident)
+	}
+	args := make([]datalog.Term, len(values))
+	for i, v := range values {
+		args[i] = target.Arg[i]
+		if !args[i].Variable() {
+			if !same(args[i], v) {
+				return
+			}
+		} else if args[i] = toConst(p.factory, v, idents[i]); args[i] == nil {
+			return
+		}
+	}
+	if consistent(target, args) {
+		discovered(datalog.NewClause(datalog.NewLiteral(p, args...)))
+	}
+}
+
+// keyValue converts t to a map key of type k. It fails if no key of type k
+// could be the same as t.
+func keyValue(t datalog.Term, k reflect.Type) (reflect.Value, bool) {
+	v := reflect.New(k).Elem()
+	switch k.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		c, ok := t.(Integer)
+		if !ok || v.OverflowInt(c.Int64()) {
+			return v, false
+		}
+		v.SetInt(c.Int64())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		c, ok := t.(Integer)
+		if !ok || c.Int64() < 0 || v.OverflowUint(uint64(c.Int64())) {
+			return v, false
+		}
+		v.SetUint(uint64(c.Int64()))
+	case reflect.String:
+		c, ok := t.(StringConst)
+		if !ok {
+			return v, false
+		}
+		v.SetString(c.StringValue())
+	default:
+		v.Set(reflect.ValueOf(t))
+	}
+	return v, true
+}
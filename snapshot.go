@@ -0,0 +1,110 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datalog
+
+import "sort"
+
+// Snapshot is an immutable view of the facts and rules held by a set of
+// DBPreds. Queries against a snapshot see the database as it was when the
+// snapshot was taken, regardless of any later calls to Assert or Retract, and
+// they may run concurrently with such calls.
+//
+// Snapshots are cheap for DBPreds using the default SliceStore: no clauses are
+// copied when a snapshot is taken. Instead, each DBPred copies its database the
+// first time it is modified after a snapshot is taken. Other stores do the same
+// if they implement Snapshotter, otherwise their clauses are copied. A snapshot
+// holds no resources other than memory, so there is nothing to release. Once a
+// snapshot is no longer referenced, any clauses that only it was holding are
+// garbage collected.
+type Snapshot struct {
+	db  map[Pred]Store
+	err map[Pred]error // errors from stores when the snapshot was taken
+}
+
+// NewSnapshot takes a snapshot of the given predicates. Preds that do not
+// embed DBPred, like custom primitives, are ignored and searched as usual
+// during queries against the snapshot. Preds that embed DBPred but are not
+// included in the snapshot appear empty to queries against the snapshot. The
+// snapshot is consistent across the predicates: every DBPred is locked before
+// any of them is shared, so it never holds the effect of one Assert or Retract
+// without the effect of those that finished before it started.
+func NewSnapshot(preds ...Pred) *Snapshot {
+	s := &Snapshot{db: make(map[Pred]Store), err: make(map[Pred]error)}
+	var db []*DBPred
+	for _, p := range preds {
+		if h, ok := p.(dbHolder); ok {
+			if _, ok := s.db[p]; !ok {
+				s.db[p] = nil
+				db = append(db, h.dbPred())
+			}
+		}
+	}
+	// Lock in a fixed order, so concurrent snapshots can't deadlock.
+	sort.Slice(db, func(i, j int) bool { return db[i].pID() < db[j].pID() })
+	for _, p := range db {
+		p.mu.Lock()
+	}
+	for _, p := range preds {
+		if h, ok := p.(dbHolder); ok && s.db[p] == nil && s.err[p] == nil {
+			s.db[p], s.err[p] = h.dbPred().share()
+		}
+	}
+	for _, p := range db {
+		p.mu.Unlock()
+	}
+	return s
+}
+
+// search examines facts and rules in the snapshot for target.Pred, which must
+// embed DBPred, and reports each one whose head unifies with target. It returns
+// any error from the store, either now or when the snapshot was taken.
+func (s *Snapshot) search(target *Literal, discovered func(c *Clause)) error {
+	if err := s.err[target.Pred]; err != nil {
+		return err
+	}
+	db, ok := s.db[target.Pred]
+	if !ok {
+		return nil
+	}
+	clauses, err := collect(db, target)
+	if err != nil {
+		return err
+	}
+	searchDB(clauses, target, discovered)
+	return nil
+}
+
+// Query returns a list of facts that unify with the given literal, using only
+// the facts and rules present when the snapshot was taken. See Literal.Query.
+func (s *Snapshot) Query(l *Literal) Answers {
+	a, _ := s.QueryErr(l)
+	return a
+}
+
+// QueryErr is like Query, but it returns an error if a predicate rejects or
+// fails the search. See Literal.QueryErr.
+func (s *Snapshot) QueryErr(l *Literal) (Answers, error) {
+	return newQuery(s).answer(l)
+}
+
+// QueryAssuming is like Query, but the assumed facts and rules are layered over
+// the snapshot for the duration of the query. See Literal.QueryAssuming.
+func (s *Snapshot) QueryAssuming(l *Literal, assumed ...*Clause) (Answers, error) {
+	q := newQuery(s)
+	if err := q.assume(assumed); err != nil {
+		return nil, err
+	}
+	return q.answer(l)
+}
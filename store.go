@@ -0,0 +1,154 @@
+// Copyright (c) 2014, Kevin Walsh.  All rights reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package datalog
+
+// Store holds the facts and rules in the database for a DBPred. The default,
+// used when DBPred.SetStore is never called, is a SliceStore held in memory.
+// Other implementations can keep clauses elsewhere, e.g. on disk.
+//
+// Clauses are identified by their variant tag (see Clause.Tag), which DBPred
+// computes and passes in, so a Store need not know anything about unification
+// or variable renaming. A DBPred serializes all calls to its Store, so
+// implementations need not be safe for concurrent use.
+type Store interface {
+	// Insert adds c to the store, unless the store already holds a clause with
+	// the same tag. The result indicates whether c was added.
+	Insert(tag string, c *Clause) (bool, error)
+
+	// Delete removes the clause with the given tag from the store, returning
+	// the removed clause, or nil if there was none.
+	Delete(tag string) (*Clause, error)
+
+	// Scan calls fn for each clause in the store whose head might unify with a
+	// literal having the given arguments. Each element of bound is either nil,
+	// meaning the argument is unbound, or a Const, meaning only clauses whose
+	// head holds that same Const or a Var in that position are of interest. If
+	// bound is nil, every clause is of interest. These are only hints: a Store
+	// may call fn for clauses that do not match, or simply for all clauses. fn
+	// must not call any method of the store.
+	Scan(bound []Term, fn func(c *Clause)) error
+}
+
+// Snapshotter is an optional interface for a Store that can provide a cheap,
+// read-only view of its current contents, for use by Snapshot. The view must
+// not be affected by later changes to the Store, and its Scan method must be
+// safe to call concurrently with those changes and with other calls to Scan.
+// For a Store that does not implement Snapshotter, NewSnapshot copies every
+// clause into a SliceStore instead.
+type Snapshotter interface {
+	Snapshot() Store
+}
+
+// Tag returns a "variant tag" for a clause, such that two clauses have the same
+// variant tag if and only if they are identical modulo variable renaming. The
+// tag depends on the identity of the predicates and terms in the clause, so it
+// is only meaningful within one process, and only while those are live.
+func (c *Clause) Tag() string {
+	return c.tag()
+}
+
+// SliceStore is a Store that holds clauses in memory. Scan ignores bound and
+// examines every clause. A SliceStore implements Snapshotter using
+// copy-on-write: no clauses are copied when a snapshot is taken, instead the
+// store copies its contents the first time it is modified afterwards.
+type SliceStore struct {
+	db     []*Clause
+	index  map[string]int // position of each clause in db, by variant tag
+	shared bool           // db is referenced elsewhere, so copy before writing
+}
+
+// NewSliceStore returns a new, empty SliceStore.
+func NewSliceStore() *SliceStore {
+	return new(SliceStore)
+}
+
+// unshare ensures s.db and s.index can be modified without disturbing any
+// snapshots.
+func (s *SliceStore) unshare() {
+	if s.shared {
+		db := make([]*Clause, len(s.db), cap(s.db))
+		copy(db, s.db)
+		s.db = db
+		s.shared = false
+	}
+	if s.index == nil {
+		s.index = make(map[string]int, len(s.db))
+		for i, c := range s.db {
+			s.index[c.tag()] = i
+		}
+	}
+}
+
+// Insert adds c to the store unless a clause with the same tag is present.
+func (s *SliceStore) Insert(tag string, c *Clause) (bool, error) {
+	s.unshare()
+	if _, ok := s.index[tag]; ok {
+		return false, nil
+	}
+	s.index[tag] = len(s.db)
+	s.db = append(s.db, c)
+	return true, nil
+}
+
+// Delete removes the clause with the given tag, moving the last clause into
+// its place.
+func (s *SliceStore) Delete(tag string) (*Clause, error) {
+	s.unshare()
+	i, ok := s.index[tag]
+	if !ok {
+		return nil, nil
+	}
+	c := s.db[i]
+	n := len(s.db)
+	s.db[i], s.db[n-1], s.db = s.db[n-1], nil, s.db[:n-1]
+	delete(s.index, tag)
+	if i < n-1 {
+		s.index[s.db[i].tag()] = i
+	}
+	return c, nil
+}
+
+// Scan calls fn for every clause in the store.
+func (s *SliceStore) Scan(bound []Term, fn func(c *Clause)) error {
+	for _, c := range s.db {
+		fn(c)
+	}
+	return nil
+}
+
+// Snapshot returns a view of the current contents of the store.
+func (s *SliceStore) Snapshot() Store {
+	s.shared = true
+	return &SliceStore{db: s.db, shared: true}
+}
+
+// collect scans s, returning the clauses that might unify with target, or all
+// clauses if target is nil.
+func collect(s Store, target *Literal) ([]*Clause, error) {
+	var bound []Term
+	if target != nil {
+		bound = make([]Term, len(target.Arg))
+		for i, arg := range target.Arg {
+			if arg.Constant() {
+				bound[i] = arg
+			}
+		}
+	}
+	var db []*Clause
+	err := s.Scan(bound, func(c *Clause) {
+		db = append(db, c)
+	})
+	return db, err
+}